@@ -0,0 +1,86 @@
+package main
+
+import (
+	auth "github.com/abbot/go-http-auth"
+	"net/http"
+)
+
+func isAdmin(username string) bool {
+	// Without any admins configured, only the first user in the PasswordFile is one.
+	if len(config.Admins) == 0 {
+		users, err := getUsers()
+		return err == nil && len(users) > 0 && users[0].Name == username
+	}
+	for _, admin := range config.Admins {
+		if admin == username {
+			return true
+		}
+	}
+	return false
+}
+
+func adminPageHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	if !isAdmin(r.Username) {
+		http.Error(w, "Du har ikke tilgang til denne siden", http.StatusForbidden)
+		return
+	}
+
+	// Get the last runs of the subscription scheduler.
+	runs, err := getSubscriptionRuns(20)
+	if err != nil {
+		logMessage("warn", "Could not get subscription runs", err)
+	}
+
+	// And of the EPG imports.
+	imports, err := getEpgImports(20)
+	if err != nil {
+		logMessage("warn", "Could not get EPG imports", err)
+	}
+
+	layout := "2006-01-02 15:04:05"
+	status := getSchedulerStatus()
+
+	d := make(map[string]interface{})
+	d["BaseUrl"] = config.BaseUrl
+	d["Title"] = "Admin"
+	d["User"] = r.Username
+	d["Admin"] = true
+	d["Runs"] = runs
+	d["Imports"] = imports
+	d["LastRun"] = ""
+	d["NextRun"] = ""
+	if !status.LastRun.IsZero() {
+		d["LastRun"] = status.LastRun.In(getLocation()).Format(layout)
+		d["NextRun"] = status.NextRun.In(getLocation()).Format(layout)
+	}
+	d["LastError"] = status.LastError
+	d["LastErrorTime"] = status.LastErrorTime.In(getLocation()).Format(layout)
+	d["Interval"] = int(getSubscriptionInterval().Minutes())
+
+	// The sources streams and recordings play from, and the last failovers.
+	failover := getFailoverStatus()
+	var feeds, events []map[string]interface{}
+	for _, f := range failover.Feeds {
+		feeds = append(feeds, map[string]interface{}{
+			"Feed":      f.Feed,
+			"Channel":   f.Channel,
+			"Source":    f.Source,
+			"Primary":   f.Primary,
+			"Failovers": f.Failovers,
+			"Since":     f.Since.In(getLocation()).Format(layout),
+		})
+	}
+	for _, e := range failover.Events {
+		events = append(events, map[string]interface{}{
+			"Time":    e.Time.In(getLocation()).Format(layout),
+			"Feed":    e.Feed,
+			"Channel": e.Channel,
+			"From":    e.From,
+			"To":      e.To,
+			"Reason":  e.Reason,
+		})
+	}
+	d["Feeds"] = feeds
+	d["FailoverEvents"] = events
+	w.Write(getPage("admin.html", d))
+}
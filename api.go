@@ -0,0 +1,803 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	auth "github.com/abbot/go-http-auth"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Where the API is, with the version, so it may change later without
+// breaking the scripts using it.
+const apiPrefix = "/api/v1/"
+
+// The description of the API, served as it is.
+const openApiFile = "contrib/openapi.yaml"
+
+// What a user is playing, as answered for the session.
+type SessionStatus struct {
+	User        string
+	Running     bool
+	Channel     string
+	Address     string
+	Transcoding int
+	URL         string
+	Viewers     string
+}
+
+// A channel, or any stream by its address, to play.
+type SessionRequest struct {
+	Channel     string
+	Name        string
+	Address     string
+	Transcoding int
+}
+
+// A single recording. The times are RFC3339, or in the time zone of the user.
+type RecordingRequest struct {
+	Channel     string
+	Title       string
+	Start       string
+	Stop        string
+	Transcoding int
+}
+
+type UserSettings struct {
+	Name          string
+	Admin         bool
+	TimeZone      string
+	URL           string
+	Notifications NotifySettings
+}
+
+// Changes to the settings of a user. Only what is given is changed.
+type UserSettingsRequest struct {
+	TimeZone      *string
+	Notifications *NotifySettings
+}
+
+func apiHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	// The rest of the path, e.g. ["recordings", "12"].
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, apiPrefix), "/"), "/")
+	switch path[0] {
+	case "channels":
+		apiChannels(w, r, path[1:])
+	case "session", "sessions":
+		apiSession(w, r, path)
+	case "recordings":
+		apiRecordings(w, r, path[1:])
+	case "subscriptions":
+		apiSubscriptions(w, r, path[1:])
+	case "favourites":
+		apiFavourites(w, r, path[1:])
+	case "archive":
+		apiArchive(w, r, path[1:])
+	case "epg":
+		apiEpg(w, r, path[1:])
+	case "nownext":
+		apiNowNext(w, r)
+	case "users":
+		apiUsers(w, r, path[1:])
+	case "openapi.yaml":
+		w.Header().Set("Content-Type", "application/yaml")
+		http.ServeFile(w, &(r.Request), openApiFile)
+	default:
+		writeJSONError(w, http.StatusNotFound, "Ukjent adresse")
+	}
+}
+
+func readJSON(w http.ResponseWriter, r *auth.AuthenticatedRequest, v interface{}) bool {
+	// Writes the error, so the caller only has to return. Only JSON is read, as
+	// forms on other sites can't send it with the login of the user.
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		writeJSONError(w, http.StatusUnsupportedMediaType, "Må sendes som application/json")
+		return false
+	}
+	err = json.NewDecoder(r.Body).Decode(v)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Ugyldig JSON")
+		return false
+	}
+	return true
+}
+
+func getApiId(path []string) (int64, bool) {
+	if len(path) == 0 {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(path[0], 10, 64)
+	return id, err == nil
+}
+
+func methodNotAllowed(w http.ResponseWriter) {
+	writeJSONError(w, http.StatusMethodNotAllowed, "Ugyldig metode")
+}
+
+func apiChannels(w http.ResponseWriter, r *auth.AuthenticatedRequest, path []string) {
+	// Everyone may see the channels, only admins change them.
+	id, single := getApiId(path)
+	if r.Method != "GET" && !isAdmin(r.Username) {
+		writeJSONError(w, http.StatusForbidden, "Bare administratorer kan endre kanaler")
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && !single:
+		writeJSON(w, http.StatusOK, getChannels())
+	case r.Method == "GET":
+		c, err := getChannelById(id)
+		if err != nil {
+			writeJSONError(w, http.StatusNotFound, "Fant ikke kanalen")
+			return
+		}
+		writeJSON(w, http.StatusOK, c)
+	case (r.Method == "POST" && !single) || (r.Method == "PUT" && single):
+		var c Channel
+		if !readJSON(w, r, &c) {
+			return
+		}
+		c.Id = 0
+		status := http.StatusCreated
+		if single {
+			if _, err := getChannelById(id); err != nil {
+				writeJSONError(w, http.StatusNotFound, "Fant ikke kanalen")
+				return
+			}
+			c.Id = id
+			status = http.StatusOK
+		}
+		c, err := saveChannel(c)
+		if err != nil {
+			logMessage("warn", "Could not save channel", err)
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, status, c)
+	case r.Method == "DELETE" && single:
+		err := deleteChannel(id)
+		if err == sql.ErrNoRows {
+			writeJSONError(w, http.StatusNotFound, "Fant ikke kanalen")
+			return
+		}
+		if err != nil {
+			logMessage("warn", "Could not delete channel", err)
+			writeJSONError(w, http.StatusInternalServerError, "Kunne ikke slette kanalen")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+func getSessionStatus(user User) SessionStatus {
+	status := SessionStatus{User: user.Name, URL: getUserURL(user)}
+	if stream, ok := getStream(user.Name); ok {
+		status.Running = true
+		status.Channel = stream.Name
+		status.Address = stream.Address
+		status.Transcoding = stream.Transcode
+		status.Viewers = countStream(stream.Pid, user)
+	}
+	return status
+}
+
+func apiSession(w http.ResponseWriter, r *auth.AuthenticatedRequest, path []string) {
+	user, err := getUserFromRequest(r)
+	if err != nil {
+		writeJSONError(w, http.StatusForbidden, "Ukjent bruker")
+		return
+	}
+
+	if len(path) > 1 {
+		writeJSONError(w, http.StatusNotFound, "Ukjent adresse")
+		return
+	}
+
+	// Admins may see what everyone is playing.
+	if path[0] == "sessions" {
+		if !isAdmin(r.Username) {
+			writeJSONError(w, http.StatusForbidden, "Bare administratorer har tilgang")
+			return
+		}
+		if r.Method != "GET" {
+			methodNotAllowed(w)
+			return
+		}
+		sessions := []SessionStatus{}
+		for name := range getStreams() {
+			if u, err := getUserFromName(name); err == nil {
+				sessions = append(sessions, getSessionStatus(u))
+			}
+		}
+		sort.Slice(sessions, func(i, j int) bool { return sessions[i].User < sessions[j].User })
+		writeJSON(w, http.StatusOK, sessions)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, getSessionStatus(user))
+	case "PUT":
+		var req SessionRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+
+		// A channel we have, or any stream given by its address.
+		var channel Channel
+		if req.Address != "" {
+			if !isAdmin(user.Name) {
+				writeJSONError(w, http.StatusForbidden, "Bare administratorer kan spille av egne adresser")
+				return
+			}
+			if !validStreamAddress(req.Address) {
+				writeJSONError(w, http.StatusBadRequest, "Ugyldig adresse, f.eks. udp://@239.0.0.1:1234 eller http://")
+				return
+			}
+			channel = Channel{Name: req.Name, Address: req.Address}
+			if channel.Name == "" {
+				channel.Name = "Egendefinert kanal"
+			}
+		} else {
+			c, err := getChannel(req.Channel, user.Name)
+			if err != nil {
+				writeJSONError(w, http.StatusNotFound, "Fant ikke kanalen")
+				return
+			}
+			channel = *c
+		}
+		if req.Transcoding < 0 {
+			writeJSONError(w, http.StatusBadRequest, "Ugyldig transkoding")
+			return
+		}
+		err = startChannel(channel, user, req.Transcoding)
+		if err != nil {
+			logMessage("warn", "Could not start stream", err)
+			writeJSONError(w, http.StatusInternalServerError, "Kunne ikke starte kanalen")
+			return
+		}
+		writeJSON(w, http.StatusOK, getSessionStatus(user))
+	case "DELETE":
+		if _, ok := getStream(user.Name); !ok {
+			writeJSONError(w, http.StatusNotFound, "Du spiller ingenting")
+			return
+		}
+		err = killUniStream(user)
+		if err != nil {
+			logMessage("warn", "Could not kill stream", err)
+			writeJSONError(w, http.StatusInternalServerError, "Kunne ikke stoppe kanalen")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+func apiRecordings(w http.ResponseWriter, r *auth.AuthenticatedRequest, path []string) {
+	loc := getUserLocation(r.Username)
+	id, single := getApiId(path)
+	if len(path) > 1 || (len(path) > 0 && !single) {
+		writeJSONError(w, http.StatusNotFound, "Fant ikke opptaket")
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && !single:
+		// The planned recordings of everyone, as on the index page, in the order they start.
+		planned := []Recording{}
+		for _, recording := range getRecordings() {
+			planned = append(planned, recording.In(loc))
+		}
+		sort.Slice(planned, func(i, j int) bool { return planned[i].StartTime.Before(planned[j].StartTime) })
+		writeJSON(w, http.StatusOK, planned)
+	case r.Method == "GET":
+		recording, ok := getRecording(id)
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "Fant ikke opptaket")
+			return
+		}
+		writeJSON(w, http.StatusOK, recording.In(loc))
+	case r.Method == "POST" && !single:
+		var req RecordingRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+		start, err := parseTimeInput(req.Start, loc)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Ugyldig starttid")
+			return
+		}
+		stop, err := parseTimeInput(req.Stop, loc)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Ugyldig sluttid")
+			return
+		}
+		if !stop.After(start) || stop.Before(time.Now()) {
+			writeJSONError(w, http.StatusBadRequest, "Opptaket må slutte etter at det starter, og ikke være ferdig")
+			return
+		}
+		if _, err := getChannel(req.Channel, ""); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Ukjent kanal")
+			return
+		}
+		id, err := startRecording(start, stop, r.Username, req.Title, req.Channel, strconv.Itoa(req.Transcoding), 0)
+		if err == errRecordingPlanned {
+			writeJSONError(w, http.StatusConflict, "Opptaket er allerede planlagt")
+			return
+		}
+		if err != nil {
+			logMessage("warn", "Could not start recording", err)
+			writeJSONError(w, http.StatusInternalServerError, "Kunne ikke planlegge opptaket")
+			return
+		}
+		w.Header().Set("Location", fmt.Sprintf("%srecordings/%d", apiPrefix, id))
+		recording, _ := getRecording(id)
+		writeJSON(w, http.StatusCreated, recording.In(loc))
+	case r.Method == "DELETE" && single:
+		// Only the one who planned it, or an admin, may stop it.
+		recording, ok := getRecording(id)
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "Fant ikke opptaket")
+			return
+		}
+		if recording.User != r.Username && !isAdmin(r.Username) {
+			writeJSONError(w, http.StatusForbidden, "Du kan bare stoppe dine egne opptak")
+			return
+		}
+		err := stopRecording(id)
+		if err != nil {
+			logMessage("warn", "Could not stop recording", err)
+			writeJSONError(w, http.StatusInternalServerError, "Kunne ikke stoppe opptaket")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+func getFollowedSubscription(w http.ResponseWriter, id int64, username string) (Subscription, bool) {
+	// Writes the error, so the caller only has to return.
+	subs, err := querySubscriptions(`WHERE s.id = $1 AND s.id IN (
+                                   SELECT subscription_id FROM subscription_followers WHERE username = $2)`, id, username)
+	if err != nil {
+		logMessage("warn", "Could not get subscription", err)
+		writeJSONError(w, http.StatusInternalServerError, "Kunne ikke hente abonnementet")
+		return Subscription{}, false
+	}
+	if len(subs) == 0 {
+		writeJSONError(w, http.StatusNotFound, "Du følger ikke abonnementet")
+		return Subscription{}, false
+	}
+	sub := subs[0]
+	sub.Follower, err = getFollower(id, username)
+	if err != nil {
+		logMessage("warn", "Could not get subscription preferences", err)
+	}
+	return sub, true
+}
+
+func writeSubscriptionPreview(w http.ResponseWriter, sub Subscription, loc *time.Location) {
+	matches, existing, err := getSubscriptionPreview(sub, loc)
+	if err != nil {
+		logMessage("warn", "Could not get subscription matches", err)
+		writeJSONError(w, http.StatusInternalServerError, "Kunne ikke hente EPG-data")
+		return
+	}
+	if matches == nil {
+		matches = []SubscriptionMatch{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"Subscription": sub,
+		"Matches":      matches,
+		"Existing":     existing,
+	})
+}
+
+func apiSubscriptions(w http.ResponseWriter, r *auth.AuthenticatedRequest, path []string) {
+	loc := getUserLocation(r.Username)
+
+	// Actions on all subscriptions first, then those on one of them.
+	if len(path) == 1 && path[0] == "check" {
+		if !isAdmin(r.Username) {
+			writeJSONError(w, http.StatusForbidden, "Bare administratorer kan sjekke abonnementene")
+			return
+		}
+		if r.Method != "POST" {
+			methodNotAllowed(w)
+			return
+		}
+		// The scheduler does the actual checking, we just ask it to do it now.
+		triggerSubscriptionCheck("manuelt av " + r.Username)
+		writeJSON(w, http.StatusAccepted, getSchedulerStatus())
+		return
+	}
+	if len(path) == 1 && path[0] == "preview" {
+		if r.Method != "POST" {
+			methodNotAllowed(w)
+			return
+		}
+		var req SubscriptionRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+		sub, err := req.Subscription(r.Username)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeSubscriptionPreview(w, sub, loc)
+		return
+	}
+
+	id, single := getApiId(path)
+	if len(path) > 0 && !single {
+		writeJSONError(w, http.StatusNotFound, "Ukjent adresse")
+		return
+	}
+	if len(path) == 2 && path[1] == "matches" && r.Method == "GET" {
+		sub, ok := getFollowedSubscription(w, id, r.Username)
+		if ok {
+			writeSubscriptionPreview(w, sub, loc)
+		}
+		return
+	}
+	if len(path) > 1 {
+		writeJSONError(w, http.StatusNotFound, "Ukjent adresse")
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && !single:
+		subs, err := getSeriesSubscriptions(r.Username)
+		if err != nil {
+			logMessage("warn", "Could not get subscriptions", err)
+			writeJSONError(w, http.StatusInternalServerError, "Kunne ikke hente abonnementene")
+			return
+		}
+		if subs == nil {
+			subs = []Subscription{}
+		}
+		writeJSON(w, http.StatusOK, subs)
+	case r.Method == "GET":
+		sub, ok := getFollowedSubscription(w, id, r.Username)
+		if ok {
+			writeJSON(w, http.StatusOK, sub)
+		}
+	case r.Method == "POST" && !single:
+		var req SubscriptionRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+		sub, err := req.Subscription(r.Username)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		sub, err = startSubscription(sub)
+		if _, ok := err.(subscriptionTimeError); ok {
+			writeJSONError(w, http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			logMessage("warn", "Could not insert the subscription", err)
+			writeJSONError(w, http.StatusInternalServerError, "Kunne ikke registrere abonnementet")
+			return
+		}
+		w.Header().Set("Location", fmt.Sprintf("%ssubscriptions/%d", apiPrefix, sub.Id))
+		writeJSON(w, http.StatusCreated, sub)
+	case r.Method == "PUT" && single:
+		// Users can only change their own preferences.
+		var f Follower
+		if !readJSON(w, r, &f) {
+			return
+		}
+		f.Username = r.Username
+		err := updateFollower(id, f)
+		if err == errNotFollowing {
+			writeJSONError(w, http.StatusNotFound, "Du følger ikke abonnementet")
+			return
+		}
+		if err != nil {
+			logMessage("warn", "Could not update subscription preferences", err)
+			writeJSONError(w, http.StatusInternalServerError, "Kunne ikke lagre innstillingene")
+			return
+		}
+		sub, ok := getFollowedSubscription(w, id, r.Username)
+		if ok {
+			writeJSON(w, http.StatusOK, sub)
+		}
+	case r.Method == "DELETE" && single:
+		err := removeSubscription(r.Username, id)
+		if err == errNotFollowing {
+			writeJSONError(w, http.StatusNotFound, "Du følger ikke abonnementet")
+			return
+		}
+		if err != nil {
+			logMessage("warn", "Could not delete the subscription", err)
+			writeJSONError(w, http.StatusInternalServerError, "Kunne ikke slette abonnementet")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+func apiFavourites(w http.ResponseWriter, r *auth.AuthenticatedRequest, path []string) {
+	// Each user has their own favourites, in the order chosen.
+	id, single := getApiId(path)
+	if len(path) > 1 || (len(path) > 0 && !single) {
+		writeJSONError(w, http.StatusNotFound, "Fant ikke kanalen")
+		return
+	}
+
+	var err error
+	switch {
+	case r.Method == "GET" && !single:
+		writeJSON(w, http.StatusOK, getFavouriteChannels(r.Username))
+		return
+	case r.Method == "PUT" && !single:
+		// The ids of the favourites, in the order they are wanted.
+		var ids []int64
+		if !readJSON(w, r, &ids) {
+			return
+		}
+		seen := make(map[int64]bool)
+		for _, id := range ids {
+			if _, err := getChannelById(id); err != nil {
+				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Fant ikke kanal %d", id))
+				return
+			}
+			if seen[id] {
+				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Kanal %d er med to ganger", id))
+				return
+			}
+			seen[id] = true
+		}
+		err = setFavourites(r.Username, ids)
+	case (r.Method == "PUT" || r.Method == "DELETE") && single:
+		if _, err := getChannelById(id); err != nil {
+			writeJSONError(w, http.StatusNotFound, "Fant ikke kanalen")
+			return
+		}
+		action := "add"
+		if r.Method == "DELETE" {
+			action = "remove"
+		}
+		err = changeFavourite(r.Username, id, action)
+	default:
+		methodNotAllowed(w)
+		return
+	}
+	if err != nil {
+		logMessage("warn", "Could not change favourite channels", err)
+		writeJSONError(w, http.StatusInternalServerError, "Kunne ikke endre favoritter")
+		return
+	}
+	writeJSON(w, http.StatusOK, getFavouriteChannels(r.Username))
+}
+
+func apiArchive(w http.ResponseWriter, r *auth.AuthenticatedRequest, path []string) {
+	switch {
+	case r.Method == "GET" && len(path) == 0:
+		files, err := getArchiveFiles(r.Username)
+		if err != nil {
+			logMessage("warn", "Could not list archive", err)
+			writeJSONError(w, http.StatusInternalServerError, "Kunne ikke hente arkivet")
+			return
+		}
+		writeJSON(w, http.StatusOK, files)
+	case r.Method == "DELETE" && len(path) == 1:
+		// Only files directly in the archive may be deleted.
+		name := path[0]
+		if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+			writeJSONError(w, http.StatusBadRequest, "Ugyldig filnavn")
+			return
+		}
+		// Only the one who recorded it, or an admin, may delete it.
+		if !mayDeleteRecording(name, r.Username) {
+			writeJSONError(w, http.StatusForbidden, "Du kan bare slette dine egne opptak")
+			return
+		}
+		err := deleteRecording(name)
+		if os.IsNotExist(err) {
+			writeJSONError(w, http.StatusNotFound, "Fant ikke filen")
+			return
+		}
+		if err != nil {
+			logMessage("warn", "Could not delete recording", err)
+			writeJSONError(w, http.StatusInternalServerError, "Kunne ikke slette filen")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+func apiEpg(w http.ResponseWriter, r *auth.AuthenticatedRequest, path []string) {
+	if r.Method != "GET" {
+		methodNotAllowed(w)
+		return
+	}
+	loc := getUserLocation(r.Username)
+
+	switch {
+	case len(path) == 0:
+		// The programmes of a channel, or of all of them, by default the next day.
+		from, to := time.Now(), time.Now().Add(24*time.Hour)
+		var err error
+		if s := r.FormValue("from"); s != "" {
+			if from, err = parseTimeInput(s, loc); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "Ugyldig starttid")
+				return
+			}
+		}
+		if s := r.FormValue("to"); s != "" {
+			if to, err = parseTimeInput(s, loc); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "Ugyldig sluttid")
+				return
+			}
+		}
+		channels := getUserChannels(r.Username, "", false)
+		if name := r.FormValue("channel"); name != "" {
+			c, err := getChannel(name, "")
+			if err != nil {
+				writeJSONError(w, http.StatusNotFound, "Fant ikke kanalen")
+				return
+			}
+			channels = []Channel{*c}
+		}
+		programmes := []EPG{}
+		for _, c := range channels {
+			list, err := epgCache.Range(c.Name, from, to)
+			if err != nil {
+				logMessage("warn", "Could not get EPG", err)
+				writeJSONError(w, http.StatusInternalServerError, "Kunne ikke hente EPG-data")
+				return
+			}
+			for _, epg := range list {
+				programmes = append(programmes, epg.In(loc))
+			}
+		}
+		writeJSON(w, http.StatusOK, programmes)
+	case len(path) == 1 && path[0] == "search":
+		hits, err := searchEpg(getSearchQuery(r, loc))
+		if err != nil {
+			logMessage("warn", "Could not search EPG", err)
+			writeJSONError(w, http.StatusInternalServerError, "Kunne ikke søke")
+			return
+		}
+		programmes := []EPG{}
+		for _, epg := range hits {
+			programmes = append(programmes, epg.In(loc))
+		}
+		writeJSON(w, http.StatusOK, programmes)
+	case len(path) == 1 && path[0] == "categories":
+		categories, err := getAllCategories()
+		if err != nil {
+			logMessage("warn", "Could not get categories from DB", err)
+			writeJSONError(w, http.StatusInternalServerError, "Kunne ikke hente kategoriene")
+			return
+		}
+		if categories == nil {
+			categories = []string{}
+		}
+		writeJSON(w, http.StatusOK, categories)
+	default:
+		writeJSONError(w, http.StatusNotFound, "Ukjent adresse")
+	}
+}
+
+func apiNowNext(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	if r.Method != "GET" {
+		methodNotAllowed(w)
+		return
+	}
+	user, err := getUserFromRequest(r)
+	if err != nil {
+		writeJSONError(w, http.StatusForbidden, "Ukjent bruker")
+		return
+	}
+	writeJSON(w, http.StatusOK, getNowNext(user, getUserLocation(user.Name)))
+}
+
+func getUserSettings(user User) UserSettings {
+	notify, err := getNotifySettings(user.Name)
+	if err != nil {
+		logMessage("warn", "Could not get notification settings", err)
+	}
+	return UserSettings{
+		Name:          user.Name,
+		Admin:         isAdmin(user.Name),
+		TimeZone:      getUserLocation(user.Name).String(),
+		URL:           getUserURL(user),
+		Notifications: notify,
+	}
+}
+
+func apiUsers(w http.ResponseWriter, r *auth.AuthenticatedRequest, path []string) {
+	user, err := getUserFromRequest(r)
+	if err != nil {
+		writeJSONError(w, http.StatusForbidden, "Ukjent bruker")
+		return
+	}
+
+	resource := strings.Join(path, "/")
+	if resource != "" && resource != "me" && resource != "me/favourites" {
+		writeJSONError(w, http.StatusNotFound, "Ukjent adresse")
+		return
+	}
+
+	switch {
+	case resource == "" && r.Method == "GET":
+		// Only admins may see who else is there.
+		if !isAdmin(r.Username) {
+			writeJSONError(w, http.StatusForbidden, "Bare administratorer har tilgang")
+			return
+		}
+		users, err := getUsers()
+		if err != nil {
+			logMessage("warn", "Could not read users", err)
+			writeJSONError(w, http.StatusInternalServerError, "Kunne ikke hente brukerne")
+			return
+		}
+		list := []UserSettings{}
+		for _, u := range users {
+			list = append(list, getUserSettings(u))
+		}
+		writeJSON(w, http.StatusOK, list)
+	case resource == "me" && r.Method == "GET":
+		writeJSON(w, http.StatusOK, getUserSettings(user))
+	case resource == "me" && r.Method == "PUT":
+		var req UserSettingsRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if req.TimeZone != nil {
+			// An empty time zone is the one of the server.
+			tz := *req.TimeZone
+			if tz == getLocation().String() {
+				tz = ""
+			}
+			err := setUserTimeZone(user.Name, tz)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, "Ukjent tidssone")
+				return
+			}
+		}
+		if req.Notifications != nil {
+			err := setNotifySettings(user.Name, *req.Notifications)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, getUserSettings(user))
+	case resource == "me/favourites":
+		// The same as /favourites.
+		apiFavourites(w, r, nil)
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+func getFavouriteChannels(username string) []Channel {
+	favourites := getUserChannels(username, "", true)
+	if favourites == nil {
+		favourites = []Channel{}
+	}
+	return favourites
+}
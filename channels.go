@@ -0,0 +1,247 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	auth "github.com/abbot/go-http-auth"
+	"github.com/lib/pq"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The channels, as stored in the DB. They are read often and changed seldom,
+// so we keep them in memory and reload them after each change.
+var channelList []Channel
+var channelLock sync.RWMutex
+
+const channelColumns = `id, name, number, coalesce(address, ''), coalesce(group_name, ''),
+                        coalesce(logo, ''), coalesce(epg_id, ''), coalesce(service_id, 0),
+                        coalesce(fallbacks, '{}')`
+
+func loadChannels() error {
+	// We'll use the DB, so ensure it is up.
+	ensureDbhConnection()
+
+	rows, err := dbh.Query("SELECT " + channelColumns + " FROM channels ORDER BY number, name")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var list []Channel
+	for rows.Next() {
+		var c Channel
+		err := rows.Scan(&c.Id, &c.Name, &c.Number, &c.Address, &c.Group, &c.Logo, &c.EPGId, &c.ServiceId, pq.Array(&c.Fallbacks))
+		if err != nil {
+			return err
+		}
+		if c.Address == "" {
+			logMessage("warn", fmt.Sprintf("Channel '%s' has no address, set it on the admin page", c.Name), nil)
+		}
+		list = append(list, c)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	channelLock.Lock()
+	channelList = list
+	channelLock.Unlock()
+	return nil
+}
+
+func seedChannels() error {
+	// We'll use the DB, so ensure it is up.
+	ensureDbhConnection()
+
+	// The channels in the config-file are only used the first time.
+	var count int
+	err := dbh.QueryRow("SELECT count(*) FROM channels").Scan(&count)
+	if err != nil || count > 0 || config.Channels == nil {
+		return err
+	}
+	for i, c := range *(config.Channels) {
+		if c.Number == 0 {
+			c.Number = i + 1
+		}
+		_, err := insertChannel(c)
+		if err != nil {
+			return err
+		}
+	}
+	logMessage("info", fmt.Sprintf("Added %d channels from the config-file to the DB", len(*(config.Channels))), nil)
+	return nil
+}
+
+func getChannels() []Channel {
+	// A copy, so callers may change it as they like.
+	channelLock.RLock()
+	defer channelLock.RUnlock()
+	return append([]Channel(nil), channelList...)
+}
+
+func getChannelById(id int64) (Channel, error) {
+	for _, c := range getChannels() {
+		if c.Id == id {
+			return c, nil
+		}
+	}
+	return Channel{}, fmt.Errorf("Did not find channel %d", id)
+}
+
+func validateChannel(c Channel) error {
+	if strings.TrimSpace(c.Name) == "" {
+		return errors.New("Kanalen må ha et navn")
+	}
+	if len(c.Name) > 30 {
+		return errors.New("Navnet kan ikke være lengre enn 30 tegn")
+	}
+	if c.Number < 0 || c.ServiceId < 0 {
+		return errors.New("Nummer og tjeneste kan ikke være negative")
+	}
+	return nil
+}
+
+func insertChannel(c Channel) (int64, error) {
+	// We'll use the DB, so ensure it is up.
+	ensureDbhConnection()
+
+	var id int64
+	err := dbh.QueryRow(`INSERT INTO channels(name, number, address, group_name, logo, epg_id, service_id, fallbacks)
+                       VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`,
+		c.Name, c.Number, c.Address, c.Group, c.Logo, c.EPGId, c.ServiceId, pq.Array(c.Fallbacks)).Scan(&id)
+	return id, err
+}
+
+func saveChannel(c Channel) (Channel, error) {
+	c.Name = strings.TrimSpace(c.Name)
+	if err := validateChannel(c); err != nil {
+		return c, err
+	}
+	if c.Id == 0 {
+		id, err := insertChannel(c)
+		if err != nil {
+			return c, err
+		}
+		c.Id = id
+		return c, loadChannels()
+	}
+
+	old, err := getChannelById(c.Id)
+	if err != nil {
+		return c, err
+	}
+
+	// We'll use the DB, so ensure it is up.
+	ensureDbhConnection()
+
+	tx, err := dbh.Begin()
+	if err != nil {
+		return c, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE channels SET name = $2, number = $3, address = $4, group_name = $5,
+                    logo = $6, epg_id = $7, service_id = $8, fallbacks = $9 WHERE id = $1`,
+		c.Id, c.Name, c.Number, c.Address, c.Group, c.Logo, c.EPGId, c.ServiceId, pq.Array(c.Fallbacks))
+	if err != nil {
+		return c, err
+	}
+
+	// Programmes, recordings and subscriptions refer to the channel by name.
+	if old.Name != c.Name {
+		for _, table := range []string{"epg", "recordings", "subscriptions", "episode_history"} {
+			_, err = tx.Exec("UPDATE "+table+" SET channel = $2 WHERE channel = $1", old.Name, c.Name)
+			if err != nil {
+				return c, err
+			}
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return c, err
+	}
+	if old.Name != c.Name {
+		refreshEpgCache()
+	}
+	return c, loadChannels()
+}
+
+func deleteChannel(id int64) error {
+	// We'll use the DB, so ensure it is up.
+	ensureDbhConnection()
+
+	res, err := dbh.Exec("DELETE FROM channels WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return loadChannels()
+}
+
+func getChannelFromForm(r *auth.AuthenticatedRequest) Channel {
+	c := Channel{
+		Name:    r.FormValue("name"),
+		Address: strings.TrimSpace(r.FormValue("address")),
+		Group:   strings.TrimSpace(r.FormValue("group")),
+		Logo:    strings.TrimSpace(r.FormValue("logo")),
+		EPGId:   strings.TrimSpace(r.FormValue("epg_id")),
+		// Given in order, separated by spaces.
+		Fallbacks: strings.Fields(r.FormValue("fallbacks")),
+	}
+	c.Id, _ = strconv.ParseInt(r.FormValue("id"), 10, 64)
+	c.Number, _ = strconv.Atoi(r.FormValue("number"))
+	c.ServiceId, _ = strconv.Atoi(r.FormValue("service_id"))
+	return c
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"Error": msg})
+}
+
+func channelsPageHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	if !isAdmin(r.Username) {
+		http.Error(w, "Bare administratorer har tilgang", http.StatusForbidden)
+		return
+	}
+
+	// Changes are posted from the forms on the page itself.
+	message := ""
+	if r.Method == "POST" {
+		c := getChannelFromForm(r)
+		var err error
+		if r.FormValue("delete") != "" {
+			err = deleteChannel(c.Id)
+		} else {
+			_, err = saveChannel(c)
+		}
+		if err == nil {
+			http.Redirect(w, &(r.Request), config.BaseUrl+"admin/channels", 302)
+			return
+		}
+		logMessage("warn", "Could not change channel", err)
+		message = err.Error()
+	}
+
+	d := make(map[string]interface{})
+	d["BaseUrl"] = config.BaseUrl
+	d["Title"] = "Kanaler"
+	d["User"] = r.Username
+	d["Admin"] = true
+	d["Channels"] = getChannels()
+	d["Message"] = message
+	d["Notice"] = r.URL.Query().Get("message")
+	w.Write(getPage("channels.html", d))
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	auth "github.com/abbot/go-http-auth"
+	"github.com/lib/pq"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// The commands tell a running server what they changed, through NOTIFY on this
+// channel in the DB, e.g. "recording:12" or "channels".
+const changesChannel = "teve_changes"
+
+// How times are given to the commands, in the time zone of the config.
+const commandTimeLayout = "2006-01-02 15:04"
+
+const commandUsage = `Usage: teve [-cubemap config] [command]
+
+Without a command, or with serve, teve runs the server. The commands are:
+
+  serve                                      run the server
+  user list                                  list the users, with their ports
+  user add NAME                              add a user, with the password from stdin
+  user remove [-force] NAME                  remove a user, where only the last
+                                             may be removed without -force, as the
+                                             ports of those after would change
+  channel list                               list the channels
+  channel add [-number N] [-group G] [-epg ID] NAME ADDRESS
+                                             add a channel
+  record list                                list the planned recordings
+  record add [-transcoding KBIT] USER CHANNEL START STOP TITLE
+                                             plan a recording, with START and STOP
+                                             as "2006-01-02 15:04"
+  record cancel ID                           cancel or stop a recording
+  subscription list [USER]                   list the subscriptions, of a user
+  subscription add [-category C] [-new-only] [-notify] USER CHANNEL WEEKDAY HOUR [TITLE]
+                                             subscribe to a programme, where
+                                             WEEKDAY is 0 for Sunday to 6
+  epg import                                 import the EPG from the sources
+  epg eit                                    import the EPG from the DVB streams
+  db migrate                                 create or update the tables from contrib/db.sql,
+                                             next to the binary or in the current folder
+`
+
+// The letters of salts in htpasswd-files.
+const saltLetters = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+func commandFailed(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", a...)
+	os.Exit(1)
+}
+
+func commandArgs(args []string, min, max int) {
+	// Exactly as many arguments as the command takes, or the usage.
+	if len(args) < min || (max >= 0 && len(args) > max) {
+		fmt.Fprint(os.Stderr, commandUsage)
+		os.Exit(2)
+	}
+}
+
+func connectCommand() {
+	// Commands fail rather than wait for the DB, as they are often run by cron.
+	var err error
+	dbh, err = getDatabaseHandler()
+	if err != nil {
+		commandFailed("Could not connect to the DB: %v", err)
+	}
+	err = seedChannels()
+	if err == nil {
+		err = loadChannels()
+	}
+	if err != nil {
+		commandFailed("Could not load channels: %v", err)
+	}
+}
+
+func notifyServer(change string) {
+	// The server may not run, so it is fine that no one listens.
+	_, err := dbh.Exec("SELECT pg_notify($1, $2)", changesChannel, change)
+	if err != nil {
+		logMessage("warn", "Could not tell the server about "+change, err)
+	}
+}
+
+// Runs the command given, and tells whether it was one, so the server
+// should not start.
+func runCommand(args []string) bool {
+	if len(args) == 0 || args[0] == "serve" {
+		return false
+	}
+	command := args[0]
+	if len(args) > 1 {
+		command += " " + args[1]
+		args = args[2:]
+	} else {
+		args = nil
+	}
+
+	switch command {
+	case "user list":
+		commandArgs(args, 0, 0)
+		userListCommand()
+	case "user add":
+		commandArgs(args, 1, 1)
+		userAddCommand(args[0])
+	case "user remove":
+		userRemoveCommand(args)
+	case "channel list":
+		commandArgs(args, 0, 0)
+		connectCommand()
+		channelListCommand()
+	case "channel add":
+		connectCommand()
+		channelAddCommand(args)
+	case "record list":
+		commandArgs(args, 0, 0)
+		connectCommand()
+		recordListCommand()
+	case "record add":
+		connectCommand()
+		recordAddCommand(args)
+	case "record cancel":
+		commandArgs(args, 1, 1)
+		connectCommand()
+		recordCancelCommand(args[0])
+	case "subscription list":
+		commandArgs(args, 0, 1)
+		connectCommand()
+		subscriptionListCommand(args)
+	case "subscription add":
+		connectCommand()
+		subscriptionAddCommand(args)
+	case "epg import":
+		commandArgs(args, 0, 0)
+		connectCommand()
+		err := importEpg()
+		notifyServer("epg")
+		if err != nil {
+			commandFailed("EPG import failed: %v", err)
+		}
+	case "epg eit":
+		commandArgs(args, 0, 0)
+		connectCommand()
+		err := importEit()
+		notifyServer("epg")
+		if err != nil {
+			commandFailed("EIT import failed: %v", err)
+		}
+	case "db migrate":
+		commandArgs(args, 0, 0)
+		dbMigrateCommand()
+	default:
+		fmt.Fprint(os.Stderr, commandUsage)
+		os.Exit(2)
+	}
+	return true
+}
+
+func readPasswordFile() []string {
+	// The lines of the PasswordFile, without the last newline.
+	f, err := ioutil.ReadFile(config.PasswordFile)
+	if err != nil && !os.IsNotExist(err) {
+		commandFailed("Could not read %s: %v", config.PasswordFile, err)
+	}
+	content := strings.TrimSuffix(string(f), "\n")
+	if content == "" {
+		return nil
+	}
+	return strings.Split(content, "\n")
+}
+
+func writePasswordFile(lines []string) {
+	content := strings.Join(lines, "\n")
+	if len(lines) > 0 {
+		content += "\n"
+	}
+	err := ioutil.WriteFile(config.PasswordFile, []byte(content), 0600)
+	if err != nil {
+		commandFailed("Could not write %s: %v", config.PasswordFile, err)
+	}
+}
+
+func hashPassword(password string) (string, error) {
+	// The Apache MD5 of htpasswd, with a random salt.
+	salt := make([]byte, 8)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	for i := range salt {
+		salt[i] = saltLetters[int(salt[i])%len(saltLetters)]
+	}
+	return string(auth.MD5Crypt([]byte(password), salt, []byte("$apr1$"))), nil
+}
+
+func userListCommand() {
+	users, err := getUsers()
+	if err != nil && !os.IsNotExist(err) {
+		commandFailed("Could not read the users: %v", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tPORT\tADMIN")
+	for _, user := range users {
+		fmt.Fprintf(w, "%s\t%d\t%v\n", user.Name, getUserPort(user), isAdmin(user.Name))
+	}
+	w.Flush()
+}
+
+func userAddCommand(name string) {
+	if name == "" || strings.ContainsAny(name, ": \t") || len(name) > 20 {
+		commandFailed("The name must be at most 20 letters, without spaces or colons")
+	}
+	lines := readPasswordFile()
+	for _, line := range lines {
+		if strings.SplitN(line, ":", 2)[0] == name {
+			commandFailed("The user %s already exists", name)
+		}
+	}
+
+	// The password is the first line of stdin, so it is not seen in ps.
+	fmt.Fprintf(os.Stderr, "Password for %s: ", name)
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		commandFailed("\nCould not read the password: %v", err)
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		commandFailed("\nThe password can not be empty")
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		commandFailed("Could not hash the password: %v", err)
+	}
+
+	// New users come last, so the ports of the others stay the same.
+	writePasswordFile(append(lines, name+":"+hash))
+	user, _ := getUserFromName(name)
+	fmt.Printf("\nAdded %s, streaming at %s\n", name, getUserURL(user))
+}
+
+func userRemoveCommand(args []string) {
+	flags := flag.NewFlagSet("user remove", flag.ExitOnError)
+	force := flags.Bool("force", false, "remove the user even if the ports of those after change")
+	flags.Parse(args)
+	commandArgs(flags.Args(), 1, 1)
+	name := flags.Arg(0)
+
+	lines := readPasswordFile()
+	var kept, after []string
+	found := false
+	for _, line := range lines {
+		user := strings.SplitN(line, ":", 2)[0]
+		if user == name {
+			found = true
+			continue
+		}
+		if found && user != "" {
+			after = append(after, user)
+		}
+		kept = append(kept, line)
+	}
+	if !found {
+		commandFailed("Did not find the user %s", name)
+	}
+	// The ports follow the order of the users, so they would move.
+	if len(after) > 0 && !*force {
+		commandFailed("Removing %s would change the ports of %s. Use -force to remove anyway.", name, strings.Join(after, ", "))
+	}
+	writePasswordFile(kept)
+	if len(after) > 0 {
+		fmt.Printf("Removed %s. The ports of %s have changed.\n", name, strings.Join(after, ", "))
+	} else {
+		fmt.Printf("Removed %s\n", name)
+	}
+}
+
+func channelListCommand() {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNUMBER\tNAME\tGROUP\tEPG\tADDRESS")
+	for _, c := range getChannels() {
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\t%s\n", c.Id, c.Number, c.Name, c.Group, c.EPGId, c.Address)
+	}
+	w.Flush()
+}
+
+func channelAddCommand(args []string) {
+	var c Channel
+	flags := flag.NewFlagSet("channel add", flag.ExitOnError)
+	flags.IntVar(&c.Number, "number", 0, "the number of the channel")
+	flags.StringVar(&c.Group, "group", "", "the group of the channel")
+	flags.StringVar(&c.EPGId, "epg", "", "the id of the channel in the XMLTV")
+	flags.Parse(args)
+	commandArgs(flags.Args(), 2, 2)
+	c.Name = flags.Arg(0)
+	c.Address = flags.Arg(1)
+
+	c, err := saveChannel(c)
+	if err != nil {
+		commandFailed("Could not add the channel: %v", err)
+	}
+	notifyServer("channels")
+	fmt.Printf("Added channel %s with id %d\n", c.Name, c.Id)
+}
+
+func recordListCommand() {
+	rows, err := dbh.Query(`SELECT id, start, stop, username, channel, title
+                          FROM recordings ORDER BY start`)
+	if err != nil {
+		commandFailed("Could not get the recordings: %v", err)
+	}
+	defer rows.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTART\tSTOP\tUSER\tCHANNEL\tTITLE")
+	for rows.Next() {
+		var id int64
+		var start, stop time.Time
+		var username, channel, title string
+		err := rows.Scan(&id, &start, &stop, &username, &channel, &title)
+		if err != nil {
+			commandFailed("Could not get the recordings: %v", err)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", id, start.In(getLocation()).Format(commandTimeLayout),
+			stop.In(getLocation()).Format(commandTimeLayout), username, channel, title)
+	}
+	w.Flush()
+}
+
+func recordAddCommand(args []string) {
+	flags := flag.NewFlagSet("record add", flag.ExitOnError)
+	transcoding := flags.Int("transcoding", 0, "transcode to this many kbit/s")
+	flags.Parse(args)
+	commandArgs(flags.Args(), 5, 5)
+	username, channel, title := flags.Arg(0), flags.Arg(1), flags.Arg(4)
+
+	if _, err := getUserFromName(username); err != nil {
+		commandFailed("Did not find the user %s", username)
+	}
+	if _, err := getChannel(channel, ""); err != nil {
+		commandFailed("Did not find the channel %s", channel)
+	}
+	start, err := time.ParseInLocation(commandTimeLayout, flags.Arg(2), getLocation())
+	if err != nil {
+		commandFailed("Could not read the start: %v", err)
+	}
+	stop, err := time.ParseInLocation(commandTimeLayout, flags.Arg(3), getLocation())
+	if err != nil {
+		commandFailed("Could not read the stop: %v", err)
+	}
+	if !stop.After(start) || !stop.After(time.Now()) {
+		commandFailed("The recording must stop after it starts, and in the future")
+	}
+
+	// The server records it, as this command does not stay running.
+	programme, _ := epgCache.Lookup(title, channel, start)
+	episode := episodeKey(programme.EpisodeNum, programme.SubTitle, programme.Description)
+	id, err := insertRecording(username, title, channel, strconv.Itoa(*transcoding), episode, 0, start, stop)
+	if err != nil {
+		commandFailed("Could not add the recording: %v", err)
+	}
+	notifyServer(fmt.Sprintf("recording:%d", id))
+	fmt.Printf("Planned recording %d\n", id)
+}
+
+func recordCancelCommand(arg string) {
+	id, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		commandFailed("The id must be a number")
+	}
+	res, err := dbh.Exec("DELETE FROM recordings WHERE id = $1", id)
+	if err != nil {
+		commandFailed("Could not cancel the recording: %v", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		commandFailed("Did not find the recording %d", id)
+	}
+	notifyServer(fmt.Sprintf("recording:%d", id))
+	fmt.Printf("Cancelled recording %d\n", id)
+}
+
+func subscriptionListCommand(args []string) {
+	var subs []Subscription
+	var err error
+	if len(args) > 0 {
+		subs, err = querySubscriptions(`WHERE s.id IN (SELECT subscription_id FROM subscription_followers
+                                    WHERE username = $1)`, args[0])
+	} else {
+		subs, err = querySubscriptions("")
+	}
+	if err != nil {
+		commandFailed("Could not get the subscriptions: %v", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTITLE\tCATEGORY\tCHANNEL\tWEEKDAY\tHOUR\tNEW ONLY\tFOLLOWERS")
+	for _, s := range subs {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%s\t%v\t%d\n", s.Id, s.Title, s.Category, s.Channel, s.Day, s.StartTime, s.NewOnly, s.Followers)
+	}
+	w.Flush()
+}
+
+func subscriptionAddCommand(args []string) {
+	var req SubscriptionRequest
+	flags := flag.NewFlagSet("subscription add", flag.ExitOnError)
+	flags.StringVar(&req.Category, "category", "", "only programmes in this category, e.g. Sport/Fotball")
+	flags.BoolVar(&req.NewOnly, "new-only", false, "skip reruns of episodes already recorded")
+	flags.BoolVar(&req.Notify, "notify", false, "notify the user of recordings")
+	flags.Parse(args)
+	commandArgs(flags.Args(), 4, 5)
+	username := flags.Arg(0)
+	req.Channel = flags.Arg(1)
+	req.Title = flags.Arg(4)
+
+	if _, err := getUserFromName(username); err != nil {
+		commandFailed("Did not find the user %s", username)
+	}
+	var err error
+	req.Weekday, err = strconv.Atoi(flags.Arg(2))
+	if err == nil {
+		req.Hour, err = strconv.Atoi(flags.Arg(3))
+	}
+	if err != nil {
+		commandFailed("The weekday and hour must be numbers")
+	}
+	sub, err := req.Subscription(username)
+	if err == nil {
+		sub, err = startSubscription(sub)
+	}
+	if err != nil {
+		commandFailed("Could not add the subscription: %v", err)
+	}
+	notifyServer("subscriptions")
+	fmt.Printf("Subscribed %s to %d\n", username, sub.Id)
+}
+
+func getSchemaFile() string {
+	// Next to the binary, so cron may run it from anywhere, or else in the
+	// current folder, as with go run.
+	if exe, err := os.Executable(); err == nil {
+		file := filepath.Join(filepath.Dir(exe), "contrib", "db.sql")
+		if _, err := os.Stat(file); err == nil {
+			return file
+		}
+	}
+	return filepath.Join("contrib", "db.sql")
+}
+
+func dbMigrateCommand() {
+	// Only connect, as the tables may not be there yet.
+	var err error
+	dbh, err = getDatabaseHandler()
+	if err != nil {
+		commandFailed("Could not connect to the DB: %v", err)
+	}
+	statements, err := ioutil.ReadFile(getSchemaFile())
+	if err != nil {
+		commandFailed("Could not read contrib/db.sql: %v", err)
+	}
+	// Without arguments, the statements are sent together.
+	_, err = dbh.Exec(string(statements))
+	if err != nil {
+		commandFailed("Could not migrate the DB: %v", err)
+	}
+	fmt.Println("The DB is up to date")
+}
+
+func applyRecordingChange(id int64) error {
+	// Cancelled, or planned, by a command.
+	var start, stop time.Time
+	var username, title, channel, transcode string
+	var subscription int64
+	err := dbh.QueryRow(`SELECT start, stop, username, title, channel, transcode, coalesce(subscription_id, 0)
+                       FROM recordings WHERE id = $1`, id).Scan(&start, &stop, &username, &title, &channel, &transcode, &subscription)
+	_, planned := getRecording(id)
+	if err == sql.ErrNoRows {
+		if planned {
+			return stopRecording(id)
+		}
+		return nil
+	}
+	if err != nil || planned {
+		return err
+	}
+	_, err = startRecording(start, stop, username, title, channel, transcode, subscription)
+	return err
+}
+
+func applyChange(change string) {
+	var err error
+	switch {
+	case change == "channels":
+		err = loadChannels()
+	case change == "subscriptions":
+		triggerSubscriptionCheck("kommandolinjen")
+	case change == "epg":
+		refreshEpgCache()
+		triggerSubscriptionCheck("EPG-import")
+	case strings.HasPrefix(change, "recording:"):
+		id, _ := strconv.ParseInt(strings.TrimPrefix(change, "recording:"), 10, 64)
+		err = applyRecordingChange(id)
+	default:
+		err = errors.New("Unknown change")
+	}
+	if err != nil {
+		logMessage("warn", "Could not apply the change "+change, err)
+	}
+}
+
+func listenForChanges() {
+	listener := pq.NewListener(getDatabaseOptions(), 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			logMessage("warn", "Lost the connection listening for changes", err)
+		}
+	})
+	err := listener.Listen(changesChannel)
+	if err != nil {
+		logMessage("warn", "Could not listen for changes from the commands", err)
+		return
+	}
+	for n := range listener.Notify {
+		// Nil after reconnecting, when changes may have been missed.
+		if n == nil {
+			logMessage("info", "Listening for changes again, those in between are missed", nil)
+			continue
+		}
+		applyChange(n.Extra)
+	}
+}
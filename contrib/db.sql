@@ -1,17 +1,37 @@
--- Delete all old EPG-data and just start anew.
-DROP TABLE IF EXISTS epg;
-CREATE TABLE epg (
+CREATE TABLE IF NOT EXISTS epg (
   title text,
-  start timestamp,
-  stop timestamp,
+  start timestamptz,
+  stop timestamptz,
   channel varchar(30),
   description text
 );
+ALTER TABLE epg ADD COLUMN IF NOT EXISTS sub_title text DEFAULT '';
+ALTER TABLE epg ADD COLUMN IF NOT EXISTS episode_num text DEFAULT '';
+ALTER TABLE epg ADD COLUMN IF NOT EXISTS categories text[] DEFAULT '{}';
+ALTER TABLE epg ADD COLUMN IF NOT EXISTS rating text DEFAULT '';
+ALTER TABLE epg ADD COLUMN IF NOT EXISTS credits jsonb DEFAULT '{}';
+ALTER TABLE epg ADD COLUMN IF NOT EXISTS icon text DEFAULT '';
+-- Where the programme is from, e.g. xmltv or eit, and the priority of that source.
+ALTER TABLE epg ADD COLUMN IF NOT EXISTS source text DEFAULT 'xmltv';
+ALTER TABLE epg ADD COLUMN IF NOT EXISTS priority int DEFAULT 0;
+CREATE INDEX IF NOT EXISTS epg_categories ON epg USING gin(categories);
+
+-- Full-text search in the EPG. Must be the same as epgSearchVector in search.go.
+CREATE INDEX IF NOT EXISTS epg_search ON epg USING gin((
+  setweight(to_tsvector('norwegian', coalesce(title, '')), 'A') ||
+  setweight(to_tsvector('norwegian', coalesce(sub_title, '')), 'B') ||
+  setweight(to_tsvector('norwegian', coalesce(description, '')), 'C')));
+
+-- Each channel has one programme at a time, which the EPG import relies on to
+-- update programmes. Duplicates from earlier imports are removed first.
+DELETE FROM epg a USING epg b
+  WHERE a.ctid < b.ctid AND a.channel = b.channel AND a.start = b.start;
+CREATE UNIQUE INDEX IF NOT EXISTS epg_channel_start ON epg(channel, start);
 
 CREATE TABLE IF NOT EXISTS recordings (
   id serial primary key,
-  start timestamp,
-  stop timestamp,
+  start timestamptz,
+  stop timestamptz,
   username varchar(20),
   title varchar(256),
   channel varchar(30),
@@ -25,10 +45,130 @@ CREATE TABLE IF NOT EXISTS subscriptions (
   interval_stop smallint,
   weekday smallint,
   channel varchar(30),
+  username varchar(20)
+);
+
+
+-- Unrelated programs may very well air in the same hours.
+ALTER TABLE subscriptions DROP CONSTRAINT IF EXISTS subscriptions_interval_start_interval_stop_key;
+
+-- Remember which episode a recording is, so reruns can be skipped.
+ALTER TABLE recordings ADD COLUMN IF NOT EXISTS episode_key text DEFAULT '';
+
+-- Subscriptions that only want episodes not recorded before.
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS new_only boolean DEFAULT false;
+
+-- Every episode we have recorded, kept even after the file is deleted.
+CREATE TABLE IF NOT EXISTS episode_history (
+  id serial primary key,
+  title text,
+  channel varchar(30),
+  episode_key text,
+  start timestamptz,
+  filename text,
+  recorded timestamptz DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS episode_history_key ON episode_history(title, episode_key);
+
+-- Log of the subscription checks done by the scheduler.
+CREATE TABLE IF NOT EXISTS subscription_runs (
+  id serial primary key,
+  reason text,
+  started timestamptz,
+  finished timestamptz,
+  recordings integer,
+  error text
+);
+
+-- The users following a subscription, each with their own preferences.
+-- keep_days is how long recordings are kept in the archive, 0 is forever.
+CREATE TABLE IF NOT EXISTS subscription_followers (
+  subscription_id integer REFERENCES subscriptions(id) ON DELETE CASCADE,
   username varchar(20),
-  unique(interval_start, interval_stop)
+  new_only boolean DEFAULT false,
+  notify boolean DEFAULT true,
+  keep_days integer DEFAULT 0,
+  primary key (subscription_id, username)
+);
+
+-- Existing subscriptions are followed by the user that created them. The
+-- new-only choice is moved to the follower.
+INSERT INTO subscription_followers(subscription_id, username, new_only)
+  SELECT id, username, new_only FROM subscriptions
+  ON CONFLICT DO NOTHING;
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS new_only;
+
+-- Which subscription a recording was made for.
+ALTER TABLE recordings ADD COLUMN IF NOT EXISTS subscription_id integer;
+ALTER TABLE episode_history ADD COLUMN IF NOT EXISTS subscription_id integer;
+ALTER TABLE episode_history ADD COLUMN IF NOT EXISTS expired boolean DEFAULT false;
+
+-- Log of the EPG imports.
+CREATE TABLE IF NOT EXISTS epg_imports (
+  id serial primary key,
+  source text,
+  started timestamptz,
+  finished timestamptz,
+  programmes integer,
+  error text
 );
 
--- Ensure that two users dont subscribe to the same program. Unecessary, as
--- both users access the same archive.
-CREATE UNIQUE INDEX unique_subscription ON subscriptions(title, weekday, channel);
+-- Subscriptions may record everything in a category, e.g. 'Sport/Football',
+-- instead of, or in addition to, a title.
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS category text DEFAULT '';
+
+-- A subscription is a rule shared by all users following the same program, so
+-- it is only recorded once.
+DROP INDEX IF EXISTS unique_subscription;
+CREATE UNIQUE INDEX IF NOT EXISTS unique_subscription_rule ON subscriptions(title, weekday, channel, category);
+
+-- Times are stored with time zone, so they are right across the changes to and
+-- from summer time. Older tables held the local time of the server, so set the
+-- time zone of the session to that of the server before running this, e.g.
+-- with PGTZ=Europe/Oslo.
+DO $$
+DECLARE
+  col record;
+BEGIN
+  FOR col IN SELECT table_name, column_name FROM information_schema.columns
+             WHERE table_schema = current_schema()
+             AND data_type = 'timestamp without time zone'
+             AND table_name IN ('epg', 'recordings', 'episode_history', 'subscription_runs', 'epg_imports')
+  LOOP
+    EXECUTE format('ALTER TABLE %I ALTER COLUMN %I TYPE timestamptz USING %I AT TIME ZONE current_setting(''TimeZone'')',
+                   col.table_name, col.column_name, col.column_name);
+  END LOOP;
+END $$;
+
+-- Settings of each user, e.g. the time zone times are shown in.
+CREATE TABLE IF NOT EXISTS user_settings (
+  username text primary key,
+  timezone text DEFAULT ''
+);
+ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS playlist_token text UNIQUE;
+-- Where each user is notified, and of which events.
+ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS notify_email text DEFAULT '';
+ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS notify_ntfy text DEFAULT '';
+ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS notify_events text[]
+  DEFAULT '{subscription.matched,recording.started,recording.finished,recording.failed,disk.low}';
+
+-- The channels, filled from the config-file the first time teve starts.
+CREATE TABLE IF NOT EXISTS channels (
+  id serial primary key,
+  name varchar(30) UNIQUE NOT NULL,
+  number integer DEFAULT 0,
+  address text DEFAULT '',
+  group_name text DEFAULT '',
+  logo text DEFAULT '',
+  epg_id text DEFAULT '',
+  service_id integer DEFAULT 0
+);
+ALTER TABLE channels ADD COLUMN IF NOT EXISTS fallbacks text[] DEFAULT '{}';
+
+-- The favourite channels of each user, in the order chosen.
+CREATE TABLE IF NOT EXISTS channel_favourites (
+  username text NOT NULL,
+  channel_id integer NOT NULL REFERENCES channels(id) ON DELETE CASCADE,
+  position integer DEFAULT 0,
+  PRIMARY KEY (username, channel_id)
+);
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Characters 0xA0-0xFF of the default DVB character table, ISO 6937 with the
+// euro sign, where 0xC1-0xCF are diacritics put in front of the letter.
+var iso6937 = [96]rune{
+	0x00A0, 0x00A1, 0x00A2, 0x00A3, 0x20AC, 0x00A5, 0x0000, 0x00A7,
+	0x00A4, 0x2018, 0x201C, 0x00AB, 0x2190, 0x2191, 0x2192, 0x2193,
+	0x00B0, 0x00B1, 0x00B2, 0x00B3, 0x00D7, 0x00B5, 0x00B6, 0x00B7,
+	0x00F7, 0x2019, 0x201D, 0x00BB, 0x00BC, 0x00BD, 0x00BE, 0x00BF,
+	0x0000, 0x0300, 0x0301, 0x0302, 0x0303, 0x0304, 0x0306, 0x0307,
+	0x0308, 0x0000, 0x030A, 0x0327, 0x0000, 0x030B, 0x0328, 0x030C,
+	0x2015, 0x00B9, 0x00AE, 0x00A9, 0x2122, 0x266A, 0x00AC, 0x00A6,
+	0x0000, 0x0000, 0x0000, 0x0000, 0x215B, 0x215C, 0x215D, 0x215E,
+	0x2126, 0x00C6, 0x0110, 0x00AA, 0x0126, 0x0000, 0x0132, 0x013F,
+	0x0141, 0x00D8, 0x0152, 0x00BA, 0x00DE, 0x0166, 0x014A, 0x0149,
+	0x0138, 0x00E6, 0x0111, 0x00F0, 0x0127, 0x0131, 0x0133, 0x0140,
+	0x0142, 0x00F8, 0x0153, 0x00DF, 0x00FE, 0x0167, 0x014B, 0x00AD,
+}
+
+// Letters with diacritics in ISO 6937, as pairs of the letter and the result.
+var iso6937Compose = map[byte]string{
+	0xC1: "AÀEÈIÌOÒUÙaàeèiìoòuù",
+	0xC2: "AÁCĆEÉIÍLĹNŃOÓRŔSŚUÚYÝZŹaácćeéiílĺnńoórŕsśuúyýzź",
+	0xC3: "AÂCĈEÊGĜHĤIÎJĴOÔSŜUÛWŴYŶaâcĉeêgĝhĥiîjĵoôsŝuûwŵyŷ",
+	0xC4: "AÃIĨNÑOÕUŨaãiĩnñoõuũ",
+	0xC5: "AĀEĒIĪOŌUŪaāeēiīoōuū",
+	0xC6: "AĂGĞUŬaăgğuŭ",
+	0xC7: "CĊEĖGĠIİZŻcċeėgġzż",
+	0xC8: "AÄEËIÏOÖUÜYŸaäeëiïoöuüyÿ",
+	0xCA: "AÅUŮaåuů",
+	0xCB: "CÇGĢKĶLĻNŅRŖSŞTŢcçgģkķlļnņrŗsştţ",
+	0xCD: "OŐUŰoőuű",
+	0xCE: "AĄEĘIĮUŲaąeęiįuų",
+	0xCF: "CČDĎEĚLĽNŇRŘSŠTŤZŽcčdďeělľnňrřsštťzž",
+}
+
+// Where the ISO 8859 parts used in the Nordic countries differ from Latin-1.
+var iso8859Differences = map[int]map[byte]rune{
+	1:  {},
+	9:  {0xD0: 'Ğ', 0xDD: 'İ', 0xDE: 'Ş', 0xF0: 'ğ', 0xFD: 'ı', 0xFE: 'ş'},
+	15: {0xA4: '€', 0xA6: 'Š', 0xA8: 'š', 0xB4: 'Ž', 0xB8: 'ž', 0xBC: 'Œ', 0xBD: 'œ', 0xBE: 'Ÿ'},
+}
+
+func composeIso6937(diacritic byte, letter byte) (rune, bool) {
+	pairs := []rune(iso6937Compose[diacritic])
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i] == rune(letter) {
+			return pairs[i+1], true
+		}
+	}
+	return 0, false
+}
+
+func decodeIso6937(b []byte) string {
+	var s strings.Builder
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		switch {
+		case c < 0x80:
+			s.WriteByte(c)
+		case c < 0xA0:
+			writeDvbControl(&s, rune(c))
+		case c >= 0xC1 && c <= 0xCF:
+			// A diacritic, which belongs to the next letter.
+			if i+1 < len(b) {
+				if r, ok := composeIso6937(c, b[i+1]); ok {
+					s.WriteRune(r)
+					i++
+					continue
+				}
+				if b[i+1] < 0x80 {
+					s.WriteByte(b[i+1])
+					i++
+				}
+			}
+			if r := iso6937[c-0xA0]; r != 0 {
+				s.WriteRune(r)
+			}
+		default:
+			if r := iso6937[c-0xA0]; r != 0 {
+				s.WriteRune(r)
+			}
+		}
+	}
+	return s.String()
+}
+
+func decodeIso8859(b []byte, part int) string {
+	// The parts we don't know are close enough to Latin-1 for the letters we use.
+	differences := iso8859Differences[part]
+	var s strings.Builder
+	for _, c := range b {
+		switch {
+		case c >= 0x80 && c < 0xA0:
+			writeDvbControl(&s, rune(c))
+		case differences[c] != 0:
+			s.WriteRune(differences[c])
+		default:
+			s.WriteRune(rune(c))
+		}
+	}
+	return s.String()
+}
+
+func decodeUcs2(b []byte) string {
+	var s strings.Builder
+	for i := 0; i+1 < len(b); i += 2 {
+		r := rune(b[i])<<8 | rune(b[i+1])
+		if r >= 0xE080 && r < 0xE0A0 {
+			writeDvbControl(&s, r-0xE000)
+			continue
+		}
+		s.WriteRune(r)
+	}
+	return s.String()
+}
+
+func decodeDvbUtf8(b []byte) string {
+	var s strings.Builder
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+		b = b[size:]
+		if r >= 0xE080 && r < 0xE0A0 {
+			writeDvbControl(&s, r-0xE000)
+			continue
+		}
+		if r != utf8.RuneError {
+			s.WriteRune(r)
+		}
+	}
+	return s.String()
+}
+
+func writeDvbControl(s *strings.Builder, c rune) {
+	// Only line breaks matter to us, emphasis and the rest are dropped.
+	if c == 0x8A {
+		s.WriteByte('\n')
+	}
+}
+
+func decodeDvbText(b []byte) string {
+	return strings.TrimSpace(decodeDvbChars(b))
+}
+
+// Decodes without trimming, for texts split over several descriptors.
+func decodeDvbChars(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+
+	// The first byte tells the character table, if it is not the default.
+	var text string
+	switch c := b[0]; {
+	case c >= 0x20:
+		text = decodeIso6937(b)
+	case c >= 0x01 && c <= 0x0B:
+		// ISO 8859-5 to 8859-15, without the never used 8859-12.
+		text = decodeIso8859(b[1:], int(c)+4)
+	case c == 0x10 && len(b) >= 3:
+		text = decodeIso8859(b[3:], int(b[1])<<8|int(b[2]))
+	case c == 0x11:
+		text = decodeUcs2(b[1:])
+	case c == 0x15:
+		text = decodeDvbUtf8(b[1:])
+	case c == 0x1F && len(b) >= 2:
+		// Compressed text we can't decode.
+		text = ""
+	default:
+		// Asian tables we don't support, so just keep what is readable.
+		text = decodeIso8859(b[1:], 1)
+	}
+	return text
+}
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An event from the EIT of a DVB transport stream.
+type eitEvent struct {
+	ServiceId   uint16
+	EventId     uint16
+	Start       time.Time
+	Stop        time.Time
+	Title       string
+	Text        string
+	Extended    string
+	Categories  []string
+	Rating      string
+	lastVersion byte
+}
+
+// Collects the sections of the tables we want from the TS packets.
+type tsDemuxer struct {
+	buffers  map[uint16][]byte
+	programs map[uint16]bool
+	events   map[uint32]*eitEvent
+}
+
+// The PIDs of the program association table and the event information table.
+const patPid = 0x00
+const eitPid = 0x12
+
+// Seconds to listen to each channel, if not given.
+const defaultEitListen = 30
+
+// Norwegian names of the top level of the DVB content genres.
+var eitGenres = map[byte]string{
+	0x1: "Film/drama",
+	0x2: "Nyheter",
+	0x3: "Underholdning",
+	0x4: "Sport",
+	0x5: "Barn/ungdom",
+	0x6: "Musikk",
+	0x7: "Kunst/kultur",
+	0x8: "Samfunn/politikk",
+	0x9: "Vitenskap",
+	0xA: "Fritid",
+}
+
+var crc32MpegTable = makeCrc32MpegTable()
+
+func makeCrc32MpegTable() [256]uint32 {
+	// MPEG uses the non-reflected CRC-32, so we can't use hash/crc32.
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}
+
+func crc32Mpeg(b []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, c := range b {
+		crc = crc<<8 ^ crc32MpegTable[byte(crc>>24)^c]
+	}
+	return crc
+}
+
+func newTsDemuxer() *tsDemuxer {
+	return &tsDemuxer{
+		buffers:  make(map[uint16][]byte),
+		programs: make(map[uint16]bool),
+		events:   make(map[uint32]*eitEvent),
+	}
+}
+
+func (d *tsDemuxer) feed(packet []byte) {
+	if len(packet) != 188 || packet[0] != 0x47 || packet[1]&0x80 != 0 {
+		// Not in sync, or the packet has errors.
+		return
+	}
+	pid := uint16(packet[1]&0x1F)<<8 | uint16(packet[2])
+	if pid != patPid && pid != eitPid {
+		return
+	}
+
+	// Skip the adaptation field, if any, and packets without payload.
+	control := packet[3] >> 4 & 0x3
+	if control&0x1 == 0 {
+		return
+	}
+	payload := packet[4:]
+	if control&0x2 != 0 {
+		if int(payload[0])+1 >= len(payload) {
+			return
+		}
+		payload = payload[1+int(payload[0]):]
+	}
+
+	if packet[1]&0x40 != 0 {
+		// A new section starts in this packet, after the end of the previous one.
+		pointer := int(payload[0])
+		if pointer+1 > len(payload) {
+			d.buffers[pid] = nil
+			return
+		}
+		if d.buffers[pid] != nil {
+			d.buffers[pid] = append(d.buffers[pid], payload[1:1+pointer]...)
+			d.collect(pid)
+		}
+		d.buffers[pid] = append([]byte{}, payload[1+pointer:]...)
+	} else if d.buffers[pid] != nil {
+		d.buffers[pid] = append(d.buffers[pid], payload...)
+	}
+	d.collect(pid)
+}
+
+func (d *tsDemuxer) collect(pid uint16) {
+	buf := d.buffers[pid]
+	for len(buf) >= 3 {
+		if buf[0] == 0xFF {
+			// The rest of the packet is stuffing.
+			buf = nil
+			break
+		}
+		length := 3 + int(binary.BigEndian.Uint16(buf[1:3])&0x0FFF)
+		if len(buf) < length {
+			break
+		}
+		if crc32Mpeg(buf[:length]) == 0 {
+			d.handleSection(buf[:length])
+		}
+		buf = buf[length:]
+	}
+	if len(buf) == 0 {
+		// Without more data, the next section must start in a new packet.
+		buf = nil
+	}
+	d.buffers[pid] = buf
+}
+
+func (d *tsDemuxer) handleSection(section []byte) {
+	tableId := section[0]
+	switch {
+	case tableId == 0x00:
+		// The programs of the stream, where 0 is the network and not a service.
+		for i := 8; i+4 <= len(section)-4; i += 4 {
+			program := binary.BigEndian.Uint16(section[i : i+2])
+			if program != 0 {
+				d.programs[program] = true
+			}
+		}
+	case tableId == 0x4E || (tableId >= 0x50 && tableId <= 0x5F):
+		// Present/following and schedule of this stream, but not of the other streams.
+		d.handleEit(section)
+	}
+}
+
+func (d *tsDemuxer) handleEit(section []byte) {
+	if len(section) < 14+4 {
+		return
+	}
+	serviceId := binary.BigEndian.Uint16(section[3:5])
+	version := section[5] >> 1 & 0x1F
+	end := len(section) - 4
+	for i := 14; i+12 <= end; {
+		eventId := binary.BigEndian.Uint16(section[i : i+2])
+		start, ok := parseDvbTime(section[i+2 : i+7])
+		duration := parseDvbDuration(section[i+7 : i+10])
+		loopLength := int(binary.BigEndian.Uint16(section[i+10:i+12]) & 0x0FFF)
+		descriptors := section[i+12:]
+		if loopLength > len(descriptors)-4 {
+			return
+		}
+		descriptors = descriptors[:loopLength]
+		i += 12 + loopLength
+		if !ok {
+			continue
+		}
+
+		// Later versions of an event replace what we have.
+		key := uint32(serviceId)<<16 | uint32(eventId)
+		if e, ok := d.events[key]; ok && e.lastVersion == version {
+			continue
+		}
+		e := &eitEvent{
+			ServiceId:   serviceId,
+			EventId:     eventId,
+			Start:       start,
+			Stop:        start.Add(duration),
+			lastVersion: version,
+		}
+		parseEitDescriptors(e, descriptors)
+		if e.Title != "" {
+			d.events[key] = e
+		}
+	}
+}
+
+func parseEitDescriptors(e *eitEvent, descriptors []byte) {
+	// The text may be split anywhere between descriptors, while each item is a line.
+	var text string
+	var lines []string
+	for len(descriptors) >= 2 {
+		tag := descriptors[0]
+		length := int(descriptors[1])
+		if 2+length > len(descriptors) {
+			return
+		}
+		data := descriptors[2 : 2+length]
+		descriptors = descriptors[2+length:]
+
+		switch tag {
+		case 0x4D:
+			// Short event: language, title and a short text.
+			if len(data) < 4 {
+				continue
+			}
+			nameLength := int(data[3])
+			if 4+nameLength+1 > len(data) {
+				continue
+			}
+			e.Title = decodeDvbText(data[4 : 4+nameLength])
+			rest := data[4+nameLength:]
+			textLength := int(rest[0])
+			if 1+textLength <= len(rest) {
+				e.Text = decodeDvbText(rest[1 : 1+textLength])
+			}
+		case 0x4E:
+			// Extended event: items and text, which may go on in more descriptors.
+			if len(data) < 5 {
+				continue
+			}
+			itemsLength := int(data[4])
+			if 5+itemsLength+1 > len(data) {
+				continue
+			}
+			items := data[5 : 5+itemsLength]
+			for len(items) >= 2 {
+				descLength := int(items[0])
+				if 1+descLength+1 > len(items) {
+					break
+				}
+				desc := decodeDvbText(items[1 : 1+descLength])
+				itemLength := int(items[1+descLength])
+				if 2+descLength+itemLength > len(items) {
+					break
+				}
+				item := decodeDvbText(items[2+descLength : 2+descLength+itemLength])
+				lines = append(lines, desc+": "+item)
+				items = items[2+descLength+itemLength:]
+			}
+			rest := data[5+itemsLength:]
+			textLength := int(rest[0])
+			if 1+textLength <= len(rest) {
+				// Each part has its own character table, so decode them one by one.
+				text += decodeDvbChars(rest[1 : 1+textLength])
+			}
+		case 0x54:
+			// Content: the genres, as nibbles.
+			for i := 0; i+2 <= len(data); i += 2 {
+				genre, ok := eitGenres[data[i]>>4]
+				if ok && !containsString(e.Categories, genre) {
+					e.Categories = append(e.Categories, genre)
+				}
+			}
+		case 0x55:
+			// Parental rating per country, where the age is the rating plus three.
+			for i := 0; i+4 <= len(data); i += 4 {
+				rating := data[i+3]
+				if rating < 0x01 || rating > 0x0F {
+					continue
+				}
+				if e.Rating == "" || string(data[i:i+3]) == "NOR" {
+					e.Rating = strconv.Itoa(int(rating) + 3)
+				}
+			}
+		}
+	}
+	if text = strings.TrimSpace(text); text != "" {
+		lines = append([]string{text}, lines...)
+	}
+	e.Extended = strings.Join(lines, "\n")
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+func bcd(b byte) int {
+	return int(b>>4)*10 + int(b&0x0F)
+}
+
+func parseDvbTime(b []byte) (time.Time, bool) {
+	// The day as a Modified Julian Date, and the time in UTC as BCD.
+	if b[0] == 0xFF && b[1] == 0xFF {
+		return time.Time{}, false
+	}
+	mjd := int(binary.BigEndian.Uint16(b[0:2]))
+	t := time.Date(1858, 11, 17, bcd(b[2]), bcd(b[3]), bcd(b[4]), 0, time.UTC).AddDate(0, 0, mjd)
+	return t.In(getLocation()), true
+}
+
+func parseDvbDuration(b []byte) time.Duration {
+	return time.Duration(bcd(b[0]))*time.Hour + time.Duration(bcd(b[1]))*time.Minute + time.Duration(bcd(b[2]))*time.Second
+}
+
+func getMulticastAddress(address string) (*net.UDPAddr, error) {
+	// E.g. "udp://@233.155.107.1:5500", or with a source in front of the @.
+	for _, prefix := range []string{"udp://", "rtp://"} {
+		if strings.HasPrefix(address, prefix) {
+			host := strings.TrimPrefix(address, prefix)
+			if i := strings.LastIndex(host, "@"); i >= 0 {
+				host = host[i+1:]
+			}
+			return net.ResolveUDPAddr("udp", host)
+		}
+	}
+	return nil, fmt.Errorf("Can't read EIT from '%s', only udp:// and rtp:// are supported", address)
+}
+
+func listenEit(address string, duration time.Duration) (*tsDemuxer, error) {
+	addr, err := getMulticastAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	var conn *net.UDPConn
+	if addr.IP.IsMulticast() {
+		conn, err = net.ListenMulticastUDP("udp", nil, addr)
+	} else {
+		conn, err = net.ListenUDP("udp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetReadBuffer(4 << 20)
+	conn.SetReadDeadline(time.Now().Add(duration))
+
+	// Read until the time is up, as the schedule is repeated slowly.
+	d := newTsDemuxer()
+	buf := make([]byte, 65536)
+	received := false
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				break
+			}
+			return d, err
+		}
+		received = true
+		data := buf[:n]
+
+		// Skip the RTP header, if the stream has one.
+		if len(data) >= 12 && data[0] != 0x47 && data[0]>>6 == 2 {
+			header := 12 + 4*int(data[0]&0x0F)
+			if data[0]&0x10 != 0 && len(data) >= header+4 {
+				header += 4 + 4*int(binary.BigEndian.Uint16(data[header+2:header+4]))
+			}
+			if header > len(data) {
+				continue
+			}
+			data = data[header:]
+		}
+		for len(data) >= 188 {
+			d.feed(data[:188])
+			data = data[188:]
+		}
+	}
+	if !received {
+		return d, errors.New("Received nothing from " + address)
+	}
+	return d, nil
+}
+
+func getEitService(channel Channel, d *tsDemuxer) (uint16, error) {
+	if channel.ServiceId != 0 {
+		return uint16(channel.ServiceId), nil
+	}
+
+	// A stream with a single service is easy, otherwise it must be configured.
+	var programs []uint16
+	for program, _ := range d.programs {
+		programs = append(programs, program)
+	}
+	if len(programs) == 1 {
+		return programs[0], nil
+	}
+	if len(programs) == 0 {
+		return 0, errors.New("Found no services in the stream")
+	}
+	return 0, fmt.Errorf("Found %d services in the stream, set ServiceId of the channel", len(programs))
+}
+
+func getEitProgrammes(channel Channel, d *tsDemuxer) ([]Programme, error) {
+	serviceId, err := getEitService(channel, d)
+	if err != nil {
+		return nil, err
+	}
+
+	var programmes []Programme
+	for _, e := range d.events {
+		if e.ServiceId != serviceId || !e.Stop.After(e.Start) {
+			continue
+		}
+
+		// The extended text often repeats the short text, only with more details.
+		description := e.Text
+		if e.Extended != "" {
+			if strings.HasPrefix(e.Extended, e.Text) {
+				description = e.Extended
+			} else if description != "" {
+				description += "\n" + e.Extended
+			} else {
+				description = e.Extended
+			}
+		}
+		programmes = append(programmes, Programme{
+			Channel:     channel.Name,
+			Title:       e.Title,
+			Description: description,
+			Categories:  e.Categories,
+			Rating:      e.Rating,
+			Credits:     map[string][]string{},
+			Start:       e.Start,
+			Stop:        e.Stop,
+		})
+	}
+	return programmes, nil
+}
+
+func importEitChannel(name string) (int, error) {
+	channel, err := getChannel(name, "")
+	if err != nil {
+		return 0, err
+	}
+	listen := config.EITListen
+	if listen <= 0 {
+		listen = defaultEitListen
+	}
+
+	d, err := listenEit(channel.Address, time.Duration(listen)*time.Second)
+	if err != nil {
+		return 0, err
+	}
+	programmes, err := getEitProgrammes(*channel, d)
+	if err != nil {
+		return 0, err
+	}
+	if len(programmes) == 0 {
+		return 0, nil
+	}
+	return len(programmes), upsertProgrammes(programmes, "eit")
+}
+
+func importEit() error {
+	// One channel at a time, so we don't join too many multicast groups at once.
+	failed := 0
+	for _, name := range config.EITChannels {
+		source := "eit:" + name
+		started := time.Now()
+		count, err := importEitChannel(name)
+		errstr := ""
+		if err != nil {
+			logMessage("warn", fmt.Sprintf("Could not import EIT from %s", name), err)
+			errstr = err.Error()
+			failed += 1
+		} else {
+			logMessage("info", fmt.Sprintf("Imported %d programmes from EIT of %s", count, name), nil)
+		}
+
+		_, err = dbh.Exec(`INSERT INTO epg_imports(source, started, finished, programmes, error)
+                       VALUES ($1, $2, $3, $4, $5)`, source, started, time.Now(), count, errstr)
+		if err != nil {
+			logMessage("warn", "Could not save the EPG import", err)
+		}
+	}
+
+	// Show the new programmes, which may also match subscriptions.
+	refreshEpgCache()
+	triggerSubscriptionCheck("EIT-import")
+
+	if failed > 0 {
+		return fmt.Errorf("%d EIT channels failed", failed)
+	}
+	return nil
+}
+
+func eitImportLoop() {
+	if config.EITInterval == 0 || len(config.EITChannels) == 0 {
+		// Don't listen for EIT unless configured.
+		return
+	}
+	for {
+		err := importEit()
+		if err != nil {
+			logMessage("warn", "Could not import EIT", err)
+		}
+		time.Sleep(time.Duration(config.EITInterval) * time.Minute)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+// An EIT present/following section for service 0x1234, with one event on
+// 2026-10-19 at 20:00 UTC lasting 45 minutes. It has a short event, an
+// extended event split over two descriptors, a content and a parental rating
+// descriptor.
+const eitSection = "4ef0881234c3000000010046004e0001ef94200000004500806d4d1c6e6f720f" +
+	"4e7968657465722070ca61204e524b084e7968657465722e4e34016e6f722404" +
+	"526567690c4f6c61204e6f72646d616e6e0c536b75657370696c6c657265044b" +
+	"6172690a44656c20656e206176204e09116e6f720003746f2e54022000550853" +
+	"5745044e4f520997f4400d"
+
+func tsPacket(pid uint16, section []byte) []byte {
+	// A single packet starting the section, padded with stuffing.
+	packet := []byte{0x47, 0x40 | byte(pid>>8), byte(pid), 0x10, 0x00}
+	packet = append(packet, section...)
+	for len(packet) < 188 {
+		packet = append(packet, 0xFF)
+	}
+	return packet
+}
+
+func TestCrc32Mpeg(t *testing.T) {
+	if got := crc32Mpeg([]byte("123456789")); got != 0x0376E6E7 {
+		t.Errorf("crc32Mpeg = %08x, want 0376e6e7", got)
+	}
+	section, _ := hex.DecodeString(eitSection)
+	if got := crc32Mpeg(section); got != 0 {
+		t.Errorf("crc32Mpeg of a section with its CRC = %08x, want 0", got)
+	}
+}
+
+func TestParseDvbTime(t *testing.T) {
+	// The example of EN 300 468: 1993-10-13 12:45:00.
+	got, ok := parseDvbTime([]byte{0xC0, 0x79, 0x12, 0x45, 0x00})
+	want := time.Date(1993, 10, 13, 12, 45, 0, 0, time.UTC)
+	if !ok || !got.Equal(want) {
+		t.Errorf("parseDvbTime = %v, %v, want %v", got, ok, want)
+	}
+	if _, ok := parseDvbTime([]byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF}); ok {
+		t.Errorf("parseDvbTime of an undefined time should fail")
+	}
+	if got := parseDvbDuration([]byte{0x01, 0x45, 0x30}); got != time.Hour+45*time.Minute+30*time.Second {
+		t.Errorf("parseDvbDuration = %v, want 1h45m30s", got)
+	}
+}
+
+func TestDecodeDvbText(t *testing.T) {
+	tests := []struct {
+		text []byte
+		want string
+	}{
+		{[]byte("Dagsrevyen"), "Dagsrevyen"},
+		{[]byte("Bl\xcaa \xc8oye, \xf1 og \xf9"), "Blå öye, æ og ø"},
+		{[]byte("Linje 1\x8aLinje 2\x86"), "Linje 1\nLinje 2"},
+		{[]byte("\x05Bl\xe5b\xe6r"), "Blåbær"},
+		{[]byte("\x10\x00\x0f\xa4 5"), "€ 5"},
+		{[]byte("\x15Bl\xc3\xa5b\xc3\xa6r"), "Blåbær"},
+		{[]byte("\x11\x00\xe6\x00\xf8"), "æø"},
+		{[]byte("  Trimmed  "), "Trimmed"},
+	}
+	for _, test := range tests {
+		if got := decodeDvbText(test.text); got != test.want {
+			t.Errorf("decodeDvbText(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestEitSection(t *testing.T) {
+	section, _ := hex.DecodeString(eitSection)
+	d := newTsDemuxer()
+	d.feed(tsPacket(eitPid, section))
+
+	e, ok := d.events[0x1234<<16|0x0001]
+	if !ok {
+		t.Fatalf("The event was not found, got %v", d.events)
+	}
+	start := time.Date(2026, 10, 19, 20, 0, 0, 0, time.UTC)
+	if !e.Start.Equal(start) || !e.Stop.Equal(start.Add(45*time.Minute)) {
+		t.Errorf("Got %v to %v, want %v to %v", e.Start, e.Stop, start, start.Add(45*time.Minute))
+	}
+	if e.Title != "Nyheter på NRK" || e.Text != "Nyheter." {
+		t.Errorf("Got the title %q and text %q", e.Title, e.Text)
+	}
+	extended := "Del en av to.\nRegi: Ola Nordmann\nSkuespillere: Kari"
+	if e.Extended != extended {
+		t.Errorf("Got the extended text %q, want %q", e.Extended, extended)
+	}
+	if len(e.Categories) != 1 || e.Categories[0] != "Nyheter" {
+		t.Errorf("Got the categories %v, want [Nyheter]", e.Categories)
+	}
+	if e.Rating != "12" {
+		t.Errorf("Got the rating %q, want the Norwegian 12", e.Rating)
+	}
+}
+
+func TestEitSectionBadCrc(t *testing.T) {
+	section, _ := hex.DecodeString(eitSection)
+	section[len(section)-1] ^= 0xFF
+	d := newTsDemuxer()
+	d.feed(tsPacket(eitPid, section))
+	if len(d.events) != 0 {
+		t.Errorf("A section with a bad CRC should be dropped, got %v", d.events)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/lib/pq"
+	"strings"
+	"time"
+)
+
+type Credit struct {
+	Role  string
+	Names string
+}
+
+// The roles of XMLTV credits, and how we present them.
+var creditRoles = []string{"director", "presenter", "actor", "writer", "producer", "commentator", "guest"}
+var creditLabels = map[string]string{
+	"director":    "Regi",
+	"presenter":   "Programleder",
+	"actor":       "Medvirkende",
+	"writer":      "Manus",
+	"producer":    "Produsent",
+	"commentator": "Kommentator",
+	"guest":       "Gjester",
+}
+
+// Columns selected for each programme, in the order scanEPG expects them.
+const epgColumns = `epg.title, epg.start, epg.stop, epg.channel, coalesce(epg.description, ''),
+                    coalesce(epg.sub_title, ''), coalesce(epg.episode_num, ''), coalesce(epg.categories, '{}'),
+                    coalesce(epg.rating, ''), coalesce(epg.credits::text, '{}'), coalesce(epg.icon, '')`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanEPG(row scanner) (EPG, error) {
+	var title, channel, description, subTitle, episodeNum, rating, credits, icon string
+	var categories []string
+	var start, stop time.Time
+	err := row.Scan(&title, &start, &stop, &channel, &description, &subTitle, &episodeNum,
+		pq.Array(&categories), &rating, &credits, &icon)
+	if err != nil {
+		return EPG{}, err
+	}
+
+	var roles map[string][]string
+	err = json.Unmarshal([]byte(credits), &roles)
+	if err != nil {
+		logMessage("warn", "Could not parse credits of programme", err)
+	}
+
+	// Times are shown in the time zone of the server, unless changed for the user.
+	start, stop = start.In(getLocation()), stop.In(getLocation())
+	short_form := "15:04"
+	long_form := "2006-01-02 15:04"
+	return EPG{
+		Title:       title,
+		Channel:     channel,
+		Start:       start.Format(short_form),
+		Stop:        stop.Format(short_form),
+		StartLong:   start.Format(long_form),
+		StopLong:    stop.Format(long_form),
+		Description: description,
+		SubTitle:    subTitle,
+		EpisodeNum:  episodeNum,
+		Episode:     formatEpisodeNum(episodeNum),
+		Categories:  categories,
+		Rating:      rating,
+		Credits:     getCredits(roles),
+		CreditRoles: roles,
+		Icon:        icon,
+		StartTime:   start,
+		StopTime:    stop,
+	}, nil
+}
+
+func getCredits(roles map[string][]string) []Credit {
+	var credits []Credit
+	for _, role := range creditRoles {
+		if len(roles[role]) > 0 {
+			credits = append(credits, Credit{Role: creditLabels[role], Names: strings.Join(roles[role], ", ")})
+		}
+	}
+	return credits
+}
+
+func formatEpisodeNum(num string) string {
+	// Show e.g. "S1E5", or just "E5" if the season is unknown.
+	normalized := normalizeEpisodeNum(num)
+	var season, episode int
+	if _, err := fmt.Sscanf(normalized, "s%de%d", &season, &episode); err != nil {
+		return strings.TrimSpace(num)
+	}
+	if season == 0 {
+		return fmt.Sprintf("E%d", episode)
+	}
+	return fmt.Sprintf("S%dE%d", season, episode)
+}
+
+func splitCategory(category string) []string {
+	// A category filter like "Sport/Football" requires all of the parts.
+	var parts []string
+	for _, part := range strings.Split(category, "/") {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+func getAllCategories() ([]string, error) {
+	// We'll use the DB, so ensure it is up.
+	ensureDbhConnection()
+
+	var categories []string
+	rows, err := dbh.Query("SELECT DISTINCT unnest(categories) AS category FROM epg ORDER BY category")
+	if err != nil {
+		return categories, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var category string
+		err := rows.Scan(&category)
+		if err != nil {
+			return categories, err
+		}
+		categories = append(categories, category)
+	}
+	return categories, rows.Err()
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// The upcoming programmes, kept in memory so pages don't query the DB for
+// each channel on every request. The lists are replaced as a whole on
+// refresh and never changed in place, so readers may share them.
+type EPGCache struct {
+	lock       sync.RWMutex
+	programmes map[string][]EPG
+	from       time.Time
+	to         time.Time
+	loaded     time.Time
+}
+
+// Default number of days ahead held in the cache, and minutes between refreshes.
+const defaultEpgCacheDays = 7
+const defaultEpgCacheInterval = 10
+
+var epgCache EPGCache
+
+func (c *EPGCache) Refresh() error {
+	// We'll use the DB, so ensure it is up.
+	ensureDbhConnection()
+
+	days := config.EPGCacheDays
+	if days <= 0 {
+		days = defaultEpgCacheDays
+	}
+
+	// From the start of yesterday, so the guide can show what has been on today
+	// also to users in other time zones.
+	now := time.Now().In(getLocation())
+	from := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, getLocation()).AddDate(0, 0, -1)
+	to := from.AddDate(0, 0, days+2)
+
+	rows, err := dbh.Query(`SELECT `+epgColumns+`
+                          FROM epg
+                          WHERE epg.stop > $1
+                          AND epg.start < $2
+                          ORDER BY epg.channel, epg.start`, from, to)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	programmes := make(map[string][]EPG)
+	for rows.Next() {
+		epg, err := scanEPG(rows)
+		if err != nil {
+			return err
+		}
+		programmes[epg.Channel] = append(programmes[epg.Channel], epg)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	c.programmes = programmes
+	c.from = from
+	c.to = to
+	c.loaded = now
+	c.lock.Unlock()
+	return nil
+}
+
+func (c *EPGCache) covers(from, to time.Time) bool {
+	return c.programmes != nil && !from.Before(c.from) && !to.After(c.to)
+}
+
+func (c *EPGCache) Upcoming(channel string, num int, categories []string) []EPG {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	// The first programmes not yet over, possibly only in some categories.
+	var upcoming []EPG
+	now := time.Now()
+	list := c.programmes[channel]
+	i := sort.Search(len(list), func(i int) bool { return list[i].StopTime.After(now) })
+	for ; i < len(list) && len(upcoming) < num; i++ {
+		if hasCategories(list[i], categories) {
+			upcoming = append(upcoming, list[i])
+		}
+	}
+	return upcoming
+}
+
+func (c *EPGCache) Range(channel string, from, to time.Time) ([]EPG, error) {
+	c.lock.RLock()
+	if !c.covers(from, to) {
+		c.lock.RUnlock()
+
+		// Outside what we hold, so ask the DB.
+		return getEpgRange(channel, from, to)
+	}
+	defer c.lock.RUnlock()
+
+	var programmes []EPG
+	list := c.programmes[channel]
+	i := sort.Search(len(list), func(i int) bool { return list[i].StopTime.After(from) })
+	for ; i < len(list) && list[i].StartTime.Before(to); i++ {
+		programmes = append(programmes, list[i])
+	}
+	return programmes, nil
+}
+
+func (c *EPGCache) Lookup(title, channel string, start time.Time) (EPG, bool) {
+	c.lock.RLock()
+	if !c.covers(start, start) {
+		c.lock.RUnlock()
+		return lookupProgramme(title, channel, start)
+	}
+	defer c.lock.RUnlock()
+
+	list := c.programmes[channel]
+	i := sort.Search(len(list), func(i int) bool { return !list[i].StartTime.Before(start) })
+	if i < len(list) && list[i].StartTime.Equal(start) && list[i].Title == title {
+		return list[i], true
+	}
+	return EPG{}, false
+}
+
+func hasCategories(epg EPG, categories []string) bool {
+	for _, category := range categories {
+		found := false
+		for _, c := range epg.Categories {
+			if c == category {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func getEpgRange(channel string, from, to time.Time) ([]EPG, error) {
+	// We'll use the DB, so ensure it is up.
+	ensureDbhConnection()
+
+	rows, err := dbh.Query(`SELECT `+epgColumns+`
+                          FROM epg
+                          WHERE epg.channel = $1
+                          AND epg.stop > $2
+                          AND epg.start < $3
+                          ORDER BY epg.start`, channel, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var programmes []EPG
+	for rows.Next() {
+		epg, err := scanEPG(rows)
+		if err != nil {
+			return programmes, err
+		}
+		programmes = append(programmes, epg)
+	}
+	return programmes, rows.Err()
+}
+
+func getChannelsWithEpg(channels []Channel, numEpg int, category string, loc *time.Location) []Channel {
+	categories := splitCategory(category)
+	for i, _ := range channels {
+		channels[i].EPGlist = nil
+		for _, epg := range epgCache.Upcoming(channels[i].Name, numEpg, categories) {
+			channels[i].EPGlist = append(channels[i].EPGlist, epg.In(loc))
+		}
+	}
+	return channels
+}
+
+func refreshEpgCache() {
+	err := epgCache.Refresh()
+	if err != nil {
+		logMessage("warn", "Could not load EPG-data into cache", err)
+	}
+}
+
+func epgCacheLoop() {
+	interval := config.EPGCacheInterval
+	if interval <= 0 {
+		interval = defaultEpgCacheInterval
+	}
+
+	// Also picks up imports done by other processes, and moves the window each day.
+	refreshEpgCache()
+	for {
+		time.Sleep(time.Duration(interval) * time.Minute)
+		refreshEpgCache()
+	}
+}
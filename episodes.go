@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"fmt"
+	"github.com/lib/pq"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Matches the on-screen episode numbering, e.g. "S01E05" or "s1 e5".
+var onscreenEpisode = regexp.MustCompile(`[Ss]\s*(\d+)\s*[Ee]\s*(\d+)`)
+
+// Matches the xmltv_ns numbering, e.g. "0.4/10." where season and episode are zero-based.
+var xmltvEpisode = regexp.MustCompile(`^\s*(\d*)\s*(?:/\s*\d+)?\s*\.\s*(\d+)\s*(?:/\s*\d+)?\s*\.`)
+
+// Matches any xmltv_ns numbering, also without the episode, e.g. "1.." for a season.
+var xmltvNumbering = regexp.MustCompile(`^\s*\d*\s*(?:/\s*\d+)?\s*\.\s*\d*\s*(?:/\s*\d+)?\s*\.`)
+
+// Descriptions shorter than this are too generic to tell episodes apart.
+const minFingerprintLength = 40
+
+func normalizeEpisodeNum(num string) string {
+	num = strings.TrimSpace(num)
+	if strings.IndexFunc(num, unicode.IsDigit) < 0 {
+		// Without any numbers it does not identify anything.
+		return ""
+	}
+
+	// The xmltv_ns-system counts from zero, so add one to get what is on screen.
+	if m := xmltvEpisode.FindStringSubmatch(num); m != nil {
+		season := 0
+		if m[1] != "" {
+			season, _ = strconv.Atoi(m[1])
+			season += 1
+		}
+		episode, _ := strconv.Atoi(m[2])
+		return fmt.Sprintf("s%de%d", season, episode+1)
+	}
+	if xmltvNumbering.MatchString(num) {
+		// Only the season or part, which all the episodes of it share.
+		return ""
+	}
+	if m := onscreenEpisode.FindStringSubmatch(num); m != nil {
+		season, _ := strconv.Atoi(m[1])
+		episode, _ := strconv.Atoi(m[2])
+		return fmt.Sprintf("s%de%d", season, episode)
+	}
+
+	// Some other system, just use it as is without spaces.
+	return strings.ToLower(strings.Join(strings.Fields(num), ""))
+}
+
+func fingerprint(text string) string {
+	// Only keep letters and digits, so whitespace and punctuation differences between
+	// airings does not matter.
+	normalized := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, text)
+	if len(normalized) < minFingerprintLength {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha1.Sum([]byte(normalized)))[:16]
+}
+
+func episodeKey(episodeNum, subTitle, description string) string {
+	// Episode numbers are the most reliable, then the sub-title, which usually is
+	// the name of the episode, and last a fingerprint of the description.
+	if num := normalizeEpisodeNum(episodeNum); num != "" {
+		return "ep:" + num
+	}
+	if sub := strings.ToLower(strings.TrimSpace(subTitle)); sub != "" {
+		return "sub:" + sub
+	}
+	if fp := fingerprint(description); fp != "" {
+		return "desc:" + fp
+	}
+
+	// We cant tell this episode apart from the others.
+	return ""
+}
+
+func lookupProgramme(title, channel string, start time.Time) (EPG, bool) {
+	// We'll use the DB, so ensure it is up.
+	ensureDbhConnection()
+
+	row := dbh.QueryRow(`SELECT `+epgColumns+`
+                       FROM epg
+                       WHERE title = $1
+                       AND channel = $2
+                       AND start = $3`, title, channel, start)
+	epg, err := scanEPG(row)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			logMessage("warn", "Could not look up programme in EPG-data", err)
+		}
+		return epg, false
+	}
+	return epg, true
+}
+
+// The episodes of the titles which have been recorded earlier, or are already
+// planned, by title and key as given by episodeId.
+func getRecordedEpisodes(titles []string) (map[string]bool, error) {
+	recorded := make(map[string]bool)
+	if len(titles) == 0 {
+		return recorded, nil
+	}
+
+	// We'll use the DB, so ensure it is up.
+	ensureDbhConnection()
+
+	rows, err := dbh.Query(`SELECT title, episode_key FROM episode_history
+                          WHERE title = ANY($1) AND episode_key <> ''
+                          UNION
+                          SELECT title, episode_key FROM recordings
+                          WHERE title = ANY($1) AND episode_key <> ''`, pq.Array(titles))
+	if err != nil {
+		return recorded, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var title, key string
+		if err := rows.Scan(&title, &key); err != nil {
+			return recorded, err
+		}
+		recorded[episodeId(title, key)] = true
+	}
+	return recorded, rows.Err()
+}
+
+func episodeId(title, key string) string {
+	return title + "\x00" + key
+}
+
+func addEpisodeHistory(title, channel, key, filename string, subscription int64, start time.Time) error {
+	// We'll use the DB, so ensure it is up.
+	ensureDbhConnection()
+
+	_, err := dbh.Exec(`INSERT INTO episode_history(title, channel, episode_key, start, filename, subscription_id)
+                      VALUES ($1, $2, $3, $4, $5, $6)`, title, channel, key, start, filename, nullId(subscription))
+	return err
+}
+
+func nullId(id int64) interface{} {
+	// Store ids of 0 as NULL, meaning there is nothing to refer to.
+	if id == 0 {
+		return nil
+	}
+	return id
+}
@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestNormalizeEpisodeNum(t *testing.T) {
+	tests := []struct {
+		num  string
+		want string
+	}{
+		{"", ""},
+		{"Episode", ""},
+		{"0.4/10.", "s1e5"},
+		{" 2 . 3 . 0/1", "s3e4"},
+		{".4.", "s0e5"},
+		{"S01E05", "s1e5"},
+		{"s1 e5", "s1e5"},
+		{"1..", ""},
+		{"1..0/2", ""},
+		{"1/3..", ""},
+		{"Del 3 av 6", "del3av6"},
+	}
+	for _, test := range tests {
+		if got := normalizeEpisodeNum(test.num); got != test.want {
+			t.Errorf("normalizeEpisodeNum(%q) = %q, want %q", test.num, got, test.want)
+		}
+	}
+}
+
+func TestEpisodeKeySeasonOnly(t *testing.T) {
+	// Without the episode, the sub-title tells the episodes apart.
+	if got := episodeKey("1..", "Pilot", ""); got != "sub:pilot" {
+		t.Errorf("episodeKey = %q, want %q", got, "sub:pilot")
+	}
+}
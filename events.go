@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The events users and webhooks may be told about.
+const (
+	EventSubscriptionMatched = "subscription.matched"
+	EventRecordingStarted    = "recording.started"
+	EventRecordingFinished   = "recording.finished"
+	EventRecordingFailed     = "recording.failed"
+	EventDiskLow             = "disk.low"
+)
+
+type EventType struct {
+	Type  string
+	Label string
+	// Only admins are told about it.
+	Admin bool
+}
+
+var eventTypes = []EventType{
+	{EventSubscriptionMatched, "Et abonnement fant en ny episode", false},
+	{EventRecordingStarted, "Et opptak startet", false},
+	{EventRecordingFinished, "Et opptak er ferdig", false},
+	{EventRecordingFailed, "Et opptak feilet", false},
+	{EventDiskLow, "Det er lite diskplass igjen", true},
+}
+
+// Something that happened, as posted to webhooks.
+type Event struct {
+	Type         string
+	Time         time.Time
+	Message      string
+	Title        string `json:",omitempty"`
+	Channel      string `json:",omitempty"`
+	Start        string `json:",omitempty"`
+	Recording    int64  `json:",omitempty"`
+	Subscription int64  `json:",omitempty"`
+	// Who the event is for.
+	Users []string
+}
+
+// A webhook in the config-file, which gets the events listed, or all if none.
+type Webhook struct {
+	URL    string
+	Secret string
+	Events []string
+}
+
+// Where each user wants to be told about events, and which.
+type NotifySettings struct {
+	Email  string
+	Ntfy   string
+	Events []string
+}
+
+// Sends events on, e.g. by email. A sink decides for itself who gets an event.
+type EventSink interface {
+	Send(e Event) error
+}
+
+// Times to try posting to a webhook, and how long to wait the first time.
+const defaultWebhookRetries = 3
+const webhookRetryWait = 5 * time.Second
+
+// MB free for the recordings below which admins are warned, and how often it is checked.
+const defaultDiskSpaceWarning = 2000
+const diskSpaceInterval = 5 * time.Minute
+
+// Events not yet sent, which are dropped if the sinks can't keep up.
+var eventQueue = make(chan Event, 100)
+
+// The number of each event since the server started, for the metrics.
+var eventCounts = make(map[string]int64)
+var eventLock sync.Mutex
+
+// Topics on ntfy, e.g. teve-espen.
+var ntfyTopic = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+func publishEvent(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	logMessage("info", fmt.Sprintf("Event %s: %s", e.Type, e.Message), nil)
+	eventLock.Lock()
+	eventCounts[e.Type] += 1
+	eventLock.Unlock()
+	notifyLive()
+	select {
+	case eventQueue <- e:
+	default:
+		logMessage("warn", "Too many events waiting, dropped "+e.Type, nil)
+	}
+}
+
+func getEventSinks() []EventSink {
+	var sinks []EventSink
+	for _, hook := range config.Webhooks {
+		sinks = append(sinks, webhookSink{hook})
+	}
+	if config.SMTPServer != "" {
+		sinks = append(sinks, emailSink{})
+	}
+	if config.NtfyServer != "" {
+		sinks = append(sinks, ntfySink{})
+	}
+	return sinks
+}
+
+func eventLoop() {
+	sinks := getEventSinks()
+	for e := range eventQueue {
+		// Each sink on its own, so a slow webhook doesn't hold back the email.
+		for _, sink := range sinks {
+			go func(sink EventSink, e Event) {
+				err := sink.Send(e)
+				if err != nil {
+					logMessage("warn", fmt.Sprintf("Could not send event %s", e.Type), err)
+				}
+			}(sink, e)
+		}
+	}
+}
+
+func containsEvent(events []string, event string) bool {
+	for _, e := range events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func getEventCounts() map[string]int64 {
+	eventLock.Lock()
+	defer eventLock.Unlock()
+	counts := make(map[string]int64)
+	for event, n := range eventCounts {
+		counts[event] = n
+	}
+	return counts
+}
+
+func getEventTitle(event string) string {
+	for _, t := range eventTypes {
+		if t.Type == event {
+			return "teve: " + t.Label
+		}
+	}
+	return "teve"
+}
+
+type webhookSink struct {
+	Webhook
+}
+
+func (h webhookSink) Send(e Event) error {
+	if len(h.Events) > 0 && !containsEvent(h.Events, e.Type) {
+		return nil
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	// Signed, so the receiver knows it is from us.
+	mac := hmac.New(sha256.New, []byte(h.Secret))
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	// The receiver may be down for a moment, so try again, waiting longer each time.
+	retries := config.WebhookRetries
+	if retries <= 0 {
+		retries = defaultWebhookRetries
+	}
+	wait := webhookRetryWait
+	for i := 1; ; i++ {
+		err = postWebhook(h.URL, e.Type, signature, body)
+		if err == nil {
+			return nil
+		}
+		if i >= retries {
+			return fmt.Errorf("Gave up posting to %s: %v", h.URL, err)
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+func postWebhook(url, event, signature string, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Teve-Event", event)
+	req.Header.Set("X-Teve-Signature", signature)
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Got status '%s'", resp.Status)
+	}
+	return nil
+}
+
+type emailSink struct{}
+
+func (emailSink) Send(e Event) error {
+	var auth smtp.Auth
+	if config.SMTPUser != "" {
+		host := strings.Split(config.SMTPServer, ":")[0]
+		auth = smtp.PlainAuth("", config.SMTPUser, config.SMTPPass, host)
+	}
+	for _, username := range e.Users {
+		settings, err := getNotifySettings(username)
+		if err != nil || settings.Email == "" || !containsEvent(settings.Events, e.Type) {
+			continue
+		}
+		msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+			config.SMTPFrom, settings.Email, mime.BEncoding.Encode("utf-8", getEventTitle(e.Type)), e.Message)
+		err = smtp.SendMail(config.SMTPServer, auth, config.SMTPFrom, []string{settings.Email}, []byte(msg))
+		if err != nil {
+			logMessage("warn", "Could not send email to "+username, err)
+		}
+	}
+	return nil
+}
+
+type ntfySink struct{}
+
+func (ntfySink) Send(e Event) error {
+	for _, username := range e.Users {
+		settings, err := getNotifySettings(username)
+		if err != nil || settings.Ntfy == "" || !containsEvent(settings.Events, e.Type) {
+			continue
+		}
+		// Published as JSON, so the title may have more than ASCII.
+		body, _ := json.Marshal(map[string]string{
+			"topic":   settings.Ntfy,
+			"title":   getEventTitle(e.Type),
+			"message": e.Message,
+		})
+		resp, err := http.Post(strings.TrimSuffix(config.NtfyServer, "/")+"/", "application/json", bytes.NewReader(body))
+		if err != nil {
+			logMessage("warn", "Could not notify "+username+" on ntfy", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			logMessage("warn", fmt.Sprintf("Could not notify %s on ntfy, got status '%s'", username, resp.Status), nil)
+		}
+	}
+	return nil
+}
+
+func getNotifySettings(username string) (NotifySettings, error) {
+	// We'll use the DB, so ensure it is up.
+	ensureDbhConnection()
+
+	s := NotifySettings{}
+	err := dbh.QueryRow(`SELECT coalesce(notify_email, ''), coalesce(notify_ntfy, ''), coalesce(notify_events, '{}')
+                       FROM user_settings WHERE username = $1`, username).Scan(&s.Email, &s.Ntfy, pq.Array(&s.Events))
+	if err == sql.ErrNoRows {
+		// Users who have not chosen get everything, once they give an address.
+		for _, t := range eventTypes {
+			s.Events = append(s.Events, t.Type)
+		}
+		return s, nil
+	}
+	return s, err
+}
+
+func setNotifySettings(username string, s NotifySettings) error {
+	s.Email = strings.TrimSpace(s.Email)
+	if s.Email != "" {
+		if _, err := mail.ParseAddress(s.Email); err != nil {
+			return errors.New("Ugyldig e-postadresse")
+		}
+	}
+	s.Ntfy = strings.TrimSpace(s.Ntfy)
+	if s.Ntfy != "" && !ntfyTopic.MatchString(s.Ntfy) {
+		return errors.New("Ugyldig ntfy-emne, bruk bare bokstaver, tall, - og _")
+	}
+	events := []string{}
+	for _, t := range eventTypes {
+		if containsEvent(s.Events, t.Type) {
+			events = append(events, t.Type)
+		}
+	}
+
+	// We'll use the DB, so ensure it is up.
+	ensureDbhConnection()
+
+	_, err := dbh.Exec(`INSERT INTO user_settings(username, notify_email, notify_ntfy, notify_events) VALUES ($1, $2, $3, $4)
+                      ON CONFLICT (username) DO UPDATE SET notify_email = EXCLUDED.notify_email,
+                      notify_ntfy = EXCLUDED.notify_ntfy, notify_events = EXCLUDED.notify_events`,
+		username, s.Email, s.Ntfy, pq.Array(events))
+	return err
+}
+
+func getEventUsers(username string, subscription int64) []string {
+	// Manual recordings are for the one who planned them.
+	if subscription == 0 {
+		return []string{username}
+	}
+
+	// We'll use the DB, so ensure it is up.
+	ensureDbhConnection()
+
+	// And those of subscriptions for the followers who want to be told.
+	users := []string{}
+	rows, err := dbh.Query(`SELECT username FROM subscription_followers
+                          WHERE subscription_id = $1 AND notify ORDER BY username`, subscription)
+	if err != nil {
+		logMessage("warn", "Could not get followers to notify", err)
+		return users
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var u string
+		if err := rows.Scan(&u); err == nil {
+			users = append(users, u)
+		}
+	}
+	return users
+}
+
+func publishRecordingEvent(event string, id int64, username, title, channel string, subscription int64, start time.Time, reason error) {
+	var message string
+	switch event {
+	case EventSubscriptionMatched:
+		message = fmt.Sprintf("Abonnementet fant %s på %s %s, som blir tatt opp.", title, channel, start.In(getLocation()).Format("02.01. kl. 15:04"))
+	case EventRecordingStarted:
+		message = fmt.Sprintf("Opptaket av %s på %s har startet.", title, channel)
+	case EventRecordingFinished:
+		message = fmt.Sprintf("Opptaket av %s på %s er ferdig, og ligger i arkivet.", title, channel)
+	case EventRecordingFailed:
+		message = fmt.Sprintf("Opptaket av %s på %s feilet: %v", title, channel, reason)
+	}
+	publishEvent(Event{
+		Type:         event,
+		Message:      message,
+		Title:        title,
+		Channel:      channel,
+		Start:        start.Format(time.RFC3339),
+		Recording:    id,
+		Subscription: subscription,
+		Users:        getEventUsers(username, subscription),
+	})
+}
+
+func getAdmins() []string {
+	admins := []string{}
+	users, err := getUsers()
+	if err != nil {
+		logMessage("warn", "Could not read users", err)
+	}
+	for _, u := range users {
+		if isAdmin(u.Name) {
+			admins = append(admins, u.Name)
+		}
+	}
+	return admins
+}
+
+func getDiskSpace() (free, size uint64, err error) {
+	// In bytes, where free is what is available to us and not only to root.
+	var st syscall.Statfs_t
+	err = syscall.Statfs(config.RecordingsFolder, &st)
+	if err != nil {
+		return 0, 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), st.Blocks * uint64(st.Bsize), nil
+}
+
+func diskSpaceLoop() {
+	warning := uint64(defaultDiskSpaceWarning)
+	if config.DiskSpaceWarning > 0 {
+		warning = uint64(config.DiskSpaceWarning)
+	}
+
+	// Warn once when it gets low, and again only after there has been enough.
+	low := false
+	for {
+		free, _, err := getDiskSpace()
+		free /= 1000000
+		if err != nil {
+			logMessage("warn", "Could not check free disk space", err)
+		} else if free < warning && !low {
+			low = true
+			publishEvent(Event{
+				Type:    EventDiskLow,
+				Message: fmt.Sprintf("Det er bare %d MB ledig til opptak i %s.", free, config.RecordingsFolder),
+				Users:   getAdmins(),
+			})
+		} else if free >= warning {
+			low = false
+		}
+		time.Sleep(diskSpaceInterval)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	auth "github.com/abbot/go-http-auth"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type xmltvChannel struct {
+	Id           string      `xml:"id,attr"`
+	DisplayNames []xmltvText `xml:"display-name"`
+}
+
+type xmltvDocument struct {
+	XMLName       xml.Name         `xml:"tv"`
+	GeneratorName string           `xml:"generator-info-name,attr"`
+	Channels      []xmltvChannel   `xml:"channel"`
+	Programmes    []xmltvProgramme `xml:"programme"`
+}
+
+// An event in the iCalendar feed of a user.
+type CalendarEvent struct {
+	Uid         string
+	Summary     string
+	Description string
+	Location    string
+	Start       time.Time
+	Stop        time.Time
+}
+
+func getXmltvProgramme(epg EPG) xmltvProgramme {
+	layout := "20060102150405 -0700"
+	p := xmltvProgramme{
+		Start:   epg.StartTime.Format(layout),
+		Stop:    epg.StopTime.Format(layout),
+		Channel: epg.Channel,
+		Titles:  []xmltvText{{Lang: "no", Value: epg.Title}},
+	}
+	if epg.SubTitle != "" {
+		p.SubTitles = []xmltvText{{Lang: "no", Value: epg.SubTitle}}
+	}
+	if epg.Description != "" {
+		p.Descs = []xmltvText{{Lang: "no", Value: epg.Description}}
+	}
+	for _, category := range epg.Categories {
+		p.Categories = append(p.Categories, xmltvText{Value: category})
+	}
+
+	// Give the numbering in xmltv_ns when we understand it, which counts from zero.
+	var season, episode int
+	if _, err := fmt.Sscanf(normalizeEpisodeNum(epg.EpisodeNum), "s%de%d", &season, &episode); err == nil {
+		ns := fmt.Sprintf(".%d.", episode-1)
+		if season > 0 {
+			ns = strconv.Itoa(season-1) + ns
+		}
+		p.EpisodeNums = append(p.EpisodeNums, xmltvEpisodeNum{System: "xmltv_ns", Value: ns})
+	}
+	if epg.Episode != "" {
+		p.EpisodeNums = append(p.EpisodeNums, xmltvEpisodeNum{System: "onscreen", Value: epg.Episode})
+	}
+
+	if len(epg.CreditRoles) > 0 {
+		roles := epg.CreditRoles
+		p.Credits = &xmltvCredits{
+			Directors:    roles["director"],
+			Actors:       roles["actor"],
+			Writers:      roles["writer"],
+			Producers:    roles["producer"],
+			Presenters:   roles["presenter"],
+			Commentators: roles["commentator"],
+			Guests:       roles["guest"],
+		}
+	}
+	if epg.Rating != "" {
+		p.Ratings = []xmltvRating{{Value: epg.Rating}}
+	}
+	if epg.Icon != "" {
+		p.Icons = []xmltvIcon{{Src: epg.Icon}}
+	}
+	return p
+}
+
+func xmltvExportHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	// From the start of today, and as many days ahead as we have in memory if not given.
+	days := config.EPGCacheDays
+	if days <= 0 {
+		days = defaultEpgCacheDays
+	}
+	if d, err := strconv.Atoi(r.FormValue("days")); err == nil && d > 0 {
+		days = d
+	}
+	now := time.Now().In(getLocation())
+	from := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, getLocation())
+	to := from.AddDate(0, 0, days)
+
+	// The channels are identified by their names in teve, which is also what we use
+	// when playing and recording them.
+	doc := xmltvDocument{GeneratorName: "teve"}
+	only := r.FormValue("channel")
+	group, onlyFavourites, _ := getChannelFilter(r)
+	for _, channel := range getUserChannels(r.Username, group, onlyFavourites) {
+		if only != "" && channel.Name != only {
+			continue
+		}
+		doc.Channels = append(doc.Channels, xmltvChannel{
+			Id:           channel.Name,
+			DisplayNames: []xmltvText{{Value: channel.Name}},
+		})
+
+		programmes, err := epgCache.Range(channel.Name, from, to)
+		if err != nil {
+			logMessage("warn", "Could not get EPG-data for export", err)
+			http.Error(w, "Kunne ikke hente EPG-data", http.StatusInternalServerError)
+			return
+		}
+		for _, epg := range programmes {
+			doc.Programmes = append(doc.Programmes, getXmltvProgramme(epg))
+		}
+	}
+
+	out, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		logMessage("warn", "Could not create XMLTV export", err)
+		http.Error(w, "Kunne ikke lage XMLTV", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Write([]byte(xml.Header + `<!DOCTYPE tv SYSTEM "xmltv.dtd">` + "\n"))
+	w.Write(out)
+	w.Write([]byte("\n"))
+}
+
+func getCalendarEvents(username string) ([]CalendarEvent, error) {
+	// We'll use the DB, so ensure it is up.
+	ensureDbhConnection()
+
+	// The planned recordings of the user, and those of the subscriptions followed.
+	rows, err := dbh.Query(`SELECT id, title, channel, start, stop
+                          FROM recordings
+                          WHERE stop > now()
+                          AND (username = $1 OR subscription_id IN (
+                               SELECT subscription_id FROM subscription_followers WHERE username = $1))
+                          ORDER BY start`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []CalendarEvent
+	for rows.Next() {
+		var id int64
+		var title, channel string
+		var start, stop time.Time
+		err := rows.Scan(&id, &title, &channel, &start, &stop)
+		if err != nil {
+			return events, err
+		}
+		event := CalendarEvent{
+			Uid:      fmt.Sprintf("recording-%d@%s", id, config.Hostname),
+			Summary:  "Opptak: " + title,
+			Location: channel,
+			Start:    start,
+			Stop:     stop,
+		}
+		if programme, ok := epgCache.Lookup(title, channel, start); ok {
+			event.Description = programme.Description
+		}
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return events, err
+	}
+
+	// And what the subscriptions will record, but is not planned yet.
+	subs, err := getSeriesSubscriptions(username)
+	if err != nil {
+		return events, err
+	}
+	for _, s := range subs {
+		matches, err := getSubscriptionMatches(s)
+		if err != nil {
+			return events, err
+		}
+		selectRecordings(matches)
+		for _, m := range matches {
+			if !m.Record {
+				continue
+			}
+			events = append(events, CalendarEvent{
+				Uid:         fmt.Sprintf("subscription-%d-%d@%s", m.Subscription, m.StartTime.Unix(), config.Hostname),
+				Summary:     "Abonnement: " + m.Title,
+				Description: m.Description,
+				Location:    m.Channel,
+				Start:       m.StartTime,
+				Stop:        m.StopTime,
+			})
+		}
+	}
+	return events, nil
+}
+
+func escapeCalendarText(s string) string {
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, ";", "\\;", -1)
+	s = strings.Replace(s, ",", "\\,", -1)
+	s = strings.Replace(s, "\r\n", "\\n", -1)
+	return strings.Replace(s, "\n", "\\n", -1)
+}
+
+func writeCalendarLine(buf *bytes.Buffer, line string) {
+	// Lines longer than 75 octets are folded, without splitting characters.
+	for len(line) > 75 {
+		cut := 75
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		buf.WriteString(line[:cut] + "\r\n")
+		line = " " + line[cut:]
+	}
+	buf.WriteString(line + "\r\n")
+}
+
+func calendarHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	events, err := getCalendarEvents(r.Username)
+	if err != nil {
+		logMessage("warn", "Could not get calendar events", err)
+		http.Error(w, "Kunne ikke hente opptak", http.StatusInternalServerError)
+		return
+	}
+
+	// Times are given in UTC, so every calendar shows them right.
+	layout := "20060102T150405Z"
+	var buf bytes.Buffer
+	writeCalendarLine(&buf, "BEGIN:VCALENDAR")
+	writeCalendarLine(&buf, "VERSION:2.0")
+	writeCalendarLine(&buf, "PRODID:-//teve//opptak//NO")
+	writeCalendarLine(&buf, "CALSCALE:GREGORIAN")
+	writeCalendarLine(&buf, "X-WR-CALNAME:teve - "+escapeCalendarText(r.Username))
+	stamp := time.Now().UTC().Format(layout)
+	for _, e := range events {
+		writeCalendarLine(&buf, "BEGIN:VEVENT")
+		writeCalendarLine(&buf, "UID:"+e.Uid)
+		writeCalendarLine(&buf, "DTSTAMP:"+stamp)
+		writeCalendarLine(&buf, "DTSTART:"+e.Start.UTC().Format(layout))
+		writeCalendarLine(&buf, "DTEND:"+e.Stop.UTC().Format(layout))
+		writeCalendarLine(&buf, "SUMMARY:"+escapeCalendarText(e.Summary))
+		writeCalendarLine(&buf, "LOCATION:"+escapeCalendarText(e.Location))
+		if e.Description != "" {
+			writeCalendarLine(&buf, "DESCRIPTION:"+escapeCalendarText(e.Description))
+		}
+		writeCalendarLine(&buf, "END:VEVENT")
+	}
+	writeCalendarLine(&buf, "END:VCALENDAR")
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", "inline; filename=teve.ics")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestXmltvEpisodeNums(t *testing.T) {
+	tests := []struct {
+		episode, num string
+		want         []xmltvEpisodeNum
+	}{
+		{"", "", nil},
+		{"S1E5", "0.4.", []xmltvEpisodeNum{{"xmltv_ns", "0.4."}, {"onscreen", "S1E5"}}},
+		{"E5", ".4.", []xmltvEpisodeNum{{"xmltv_ns", ".4."}, {"onscreen", "E5"}}},
+		{"Del 3", "Del 3", []xmltvEpisodeNum{{"onscreen", "Del 3"}}},
+		// Only what is shown decides whether there is an onscreen number.
+		{"", " ", nil},
+	}
+	for _, test := range tests {
+		p := getXmltvProgramme(EPG{Episode: test.episode, EpisodeNum: test.num})
+		if !reflect.DeepEqual(p.EpisodeNums, test.want) {
+			t.Errorf("episode-num of %q, %q = %v, want %v", test.episode, test.num, p.EpisodeNums, test.want)
+		}
+	}
+}
+
+func TestWriteCalendarLine(t *testing.T) {
+	tests := []string{
+		"SUMMARY:Dagsrevyen",
+		strings.Repeat("a", 75),
+		"DESCRIPTION:" + strings.Repeat("b", 200),
+		// Multibyte characters across the folds are not split.
+		"DESCRIPTION:" + strings.Repeat("æøå", 60),
+	}
+	for _, line := range tests {
+		var buf bytes.Buffer
+		writeCalendarLine(&buf, line)
+		out := buf.String()
+		if !strings.HasSuffix(out, "\r\n") {
+			t.Errorf("%q does not end with CRLF", out)
+		}
+		parts := strings.Split(strings.TrimSuffix(out, "\r\n"), "\r\n")
+		unfolded := parts[0]
+		for i, part := range parts {
+			if len(part) > 75 {
+				t.Errorf("Line %d of %q is %d octets", i, line, len(part))
+			}
+			if !utf8.ValidString(part) {
+				t.Errorf("Line %d of %q splits a character", i, line)
+			}
+			if i > 0 {
+				if !strings.HasPrefix(part, " ") {
+					t.Errorf("Line %d of %q does not start with a space", i, line)
+				}
+				unfolded += part[1:]
+			}
+		}
+		if unfolded != line {
+			t.Errorf("Unfolded %q, want %q", unfolded, line)
+		}
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// Seconds a source may go without data before we switch to the next, and
+// between each check of whether the first source is back, if not configured.
+const defaultFailoverTimeout = 10
+const defaultFailbackInterval = 60
+
+// How many failovers we remember for the status.
+const maxFailoverEvents = 50
+
+// The size of a MPEG-TS packet, which we switch sources between.
+const tsPacketSize = 188
+
+// A switch from one source of a channel to another.
+type FailoverEvent struct {
+	Time    time.Time
+	Feed    string
+	Channel string
+	From    string
+	To      string
+	Reason  string
+}
+
+// The source a stream or recording is playing from now.
+type FeedStatus struct {
+	Feed      string
+	Channel   string
+	Source    string
+	Primary   bool
+	Failovers int
+	Since     time.Time
+}
+
+type FailoverStatus struct {
+	Feeds  []FeedStatus
+	Events []FailoverEvent
+	// Since the server started.
+	Restarts  int64
+	Failovers int64
+}
+
+// Feeds a stream or recording, a VLC reading from stdin, from the sources of a
+// channel. Each source is read by its own VLC, writing MPEG-TS to us.
+type sourceFeeder struct {
+	// What it is found by in feeders, the command it feeds.
+	key     interface{}
+	name    string
+	channel string
+	sources []string
+	out     io.WriteCloser
+	stop    chan bool
+
+	// Guarded by feederLock, for the status.
+	current   int
+	failovers int
+	since     time.Time
+}
+
+// A running source, and the data read from it.
+type sourceReader struct {
+	index int
+	cmd   *exec.Cmd
+	data  chan []byte
+}
+
+// The feeders by what they feed, e.g. the command, so they stop with it.
+var feeders = make(map[interface{}]*sourceFeeder)
+var failoverEvents []FailoverEvent
+var feederLock sync.Mutex
+
+// VLCs started again for a source, and switches between sources, since the
+// server started. Guarded by feederLock.
+var sourceRestarts int64
+var failoverCount int64
+
+func (c Channel) Sources() []string {
+	// The address first, then the fallbacks in order.
+	sources := []string{}
+	if c.Address != "" {
+		sources = append(sources, c.Address)
+	}
+	for _, source := range c.Fallbacks {
+		if source != "" {
+			sources = append(sources, source)
+		}
+	}
+	return sources
+}
+
+func getFailoverTimeout() time.Duration {
+	if config.FailoverTimeout <= 0 {
+		return defaultFailoverTimeout * time.Second
+	}
+	return time.Duration(config.FailoverTimeout) * time.Second
+}
+
+func getFailbackInterval() time.Duration {
+	if config.FailbackInterval <= 0 {
+		return defaultFailbackInterval * time.Second
+	}
+	return time.Duration(config.FailbackInterval) * time.Second
+}
+
+func startFeeder(cmd *exec.Cmd, name string, channel Channel) error {
+	// The command reads the stream from stdin, and is started here.
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	runFeeder(cmd, stdin, name, channel)
+	return nil
+}
+
+func runFeeder(key interface{}, out io.WriteCloser, name string, channel Channel) {
+	// Feeds out until stopped by the key, or out can't be written to.
+	f := &sourceFeeder{
+		key:     key,
+		name:    name,
+		channel: channel.Name,
+		sources: channel.Sources(),
+		out:     out,
+		stop:    make(chan bool),
+		since:   time.Now(),
+	}
+	feederLock.Lock()
+	feeders[key] = f
+	feederLock.Unlock()
+
+	go f.run()
+}
+
+func stopFeeder(key interface{}) {
+	feederLock.Lock()
+	f, ok := feeders[key]
+	delete(feeders, key)
+	feederLock.Unlock()
+	if ok {
+		close(f.stop)
+	}
+}
+
+func startSourceReader(address string, index int) (*sourceReader, error) {
+	// Tokenised addresses are resolved each time, as they expire.
+	resolved, err := resolveAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command("cvlc", "-q", resolved, "--sout", "#std{access=file,mux=ts,dst=-}")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &sourceReader{index: index, cmd: cmd, data: make(chan []byte, 64)}
+	go func() {
+		defer close(r.data)
+		for {
+			buf := make([]byte, 64*tsPacketSize)
+			n, err := stdout.Read(buf)
+			if n > 0 {
+				r.data <- buf[:n]
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return r, nil
+}
+
+func (r *sourceReader) kill() {
+	if r == nil {
+		return
+	}
+	r.cmd.Process.Kill()
+	go func() {
+		// Empty what is read, so the reading ends.
+		for _ = range r.data {
+		}
+		r.cmd.Wait()
+	}()
+}
+
+func (f *sourceFeeder) startFrom(index int, reason string) *sourceReader {
+	// Try each source once, starting with the given one.
+	for i := 0; i < len(f.sources); i++ {
+		next := (index + i) % len(f.sources)
+		if reason != "startet" || i > 0 {
+			feederLock.Lock()
+			sourceRestarts += 1
+			feederLock.Unlock()
+		}
+		r, err := startSourceReader(f.sources[next], next)
+		if err != nil {
+			logMessage("warn", fmt.Sprintf("Could not start source %d of '%s'", next+1, f.channel), err)
+			continue
+		}
+		f.switchTo(next, reason)
+		return r
+	}
+	return nil
+}
+
+func (f *sourceFeeder) switchTo(index int, reason string) {
+	feederLock.Lock()
+	defer feederLock.Unlock()
+	if index == f.current {
+		return
+	}
+
+	event := FailoverEvent{
+		Time:    time.Now(),
+		Feed:    f.name,
+		Channel: f.channel,
+		From:    f.sources[f.current],
+		To:      f.sources[index],
+		Reason:  reason,
+	}
+	logMessage("warn", fmt.Sprintf("Switched %s of '%s' from '%s' to '%s': %s", f.name, f.channel, event.From, event.To, reason), nil)
+	failoverEvents = append(failoverEvents, event)
+	if len(failoverEvents) > maxFailoverEvents {
+		failoverEvents = failoverEvents[len(failoverEvents)-maxFailoverEvents:]
+	}
+	f.current = index
+	f.failovers += 1
+	failoverCount += 1
+	f.since = event.Time
+}
+
+func (f *sourceFeeder) run() {
+	timeout := getFailoverTimeout()
+	failback := getFailbackInterval()
+	ticker := time.NewTicker(time.Second)
+	var reader, probe *sourceReader
+	var probeStarted time.Time
+	defer func() {
+		ticker.Stop()
+		reader.kill()
+		probe.kill()
+		f.out.Close()
+
+		// Not fed any more, also when it stopped by itself, so the status
+		// doesn't show it.
+		feederLock.Lock()
+		if feeders[f.key] == f {
+			delete(feeders, f.key)
+		}
+		feederLock.Unlock()
+	}()
+
+	// Only whole packets are passed on, so VLC gets a clean cut when we switch.
+	var pending []byte
+	write := func(data []byte) error {
+		pending = append(pending, data...)
+		for len(pending) > 0 && pending[0] != 0x47 {
+			pending = pending[1:]
+		}
+		n := len(pending) / tsPacketSize * tsPacketSize
+		if n == 0 {
+			return nil
+		}
+		_, err := f.out.Write(pending[:n])
+		pending = append([]byte(nil), pending[n:]...)
+		return err
+	}
+
+	reader = f.startFrom(0, "startet")
+	lastData := time.Now()
+	lastFailback := time.Now()
+	for {
+		var data, probeData chan []byte
+		if reader != nil {
+			data = reader.data
+		}
+		if probe != nil {
+			probeData = probe.data
+		}
+
+		select {
+		case <-f.stop:
+			return
+		case chunk, ok := <-data:
+			if !ok {
+				reader.kill()
+				reader = f.startFrom(f.current+1, "kilden stoppet")
+				pending = nil
+				lastData = time.Now()
+				continue
+			}
+			lastData = time.Now()
+			if err := write(chunk); err != nil {
+				// What we feed has stopped, so we are done.
+				return
+			}
+		case chunk, ok := <-probeData:
+			if !ok {
+				probe.kill()
+				probe = nil
+				continue
+			}
+			// The first source is back, so switch to it.
+			reader.kill()
+			reader, probe = probe, nil
+			f.switchTo(0, "hovedkilden virker igjen")
+			pending = nil
+			lastData = time.Now()
+			if err := write(chunk); err != nil {
+				return
+			}
+		case now := <-ticker.C:
+			if now.Sub(lastData) > timeout {
+				// Nothing for too long, try the next source.
+				next := 0
+				if reader != nil {
+					next = reader.index + 1
+				}
+				reader.kill()
+				reader = f.startFrom(next, fmt.Sprintf("ingen data på %d sekunder", int(timeout.Seconds())))
+				pending = nil
+				lastData = now
+			}
+			if probe != nil && now.Sub(probeStarted) > timeout {
+				probe.kill()
+				probe = nil
+			}
+			if probe == nil && reader != nil && reader.index != 0 && now.Sub(lastFailback) > failback {
+				// Check if the first source is back, without leaving the one that works.
+				lastFailback = now
+				probeStarted = now
+				p, err := startSourceReader(f.sources[0], 0)
+				if err == nil {
+					probe = p
+				}
+			}
+		}
+	}
+}
+
+func getFailoverStatus() FailoverStatus {
+	feederLock.Lock()
+	defer feederLock.Unlock()
+
+	status := FailoverStatus{Restarts: sourceRestarts, Failovers: failoverCount}
+	for _, f := range feeders {
+		status.Feeds = append(status.Feeds, FeedStatus{
+			Feed:      f.name,
+			Channel:   f.channel,
+			Source:    f.sources[f.current],
+			Primary:   f.current == 0,
+			Failovers: f.failovers,
+			Since:     f.since,
+		})
+	}
+	// The newest first.
+	for i := len(failoverEvents) - 1; i >= 0; i-- {
+		status.Events = append(status.Events, failoverEvents[i])
+	}
+	return status
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	auth "github.com/abbot/go-http-auth"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func getFavourites(username string) ([]int64, error) {
+	// We'll use the DB, so ensure it is up.
+	ensureDbhConnection()
+
+	rows, err := dbh.Query("SELECT channel_id FROM channel_favourites WHERE username = $1 ORDER BY position", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func setFavourites(username string, ids []int64) error {
+	// We'll use the DB, so ensure it is up.
+	ensureDbhConnection()
+
+	// The order is rewritten as a whole, which is simple as there are few of them.
+	tx, err := dbh.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM channel_favourites WHERE username = $1", username)
+	if err != nil {
+		return err
+	}
+	for i, id := range ids {
+		_, err = tx.Exec("INSERT INTO channel_favourites(username, channel_id, position) VALUES ($1, $2, $3)", username, id, i)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func changeFavourite(username string, id int64, action string) error {
+	ids, err := getFavourites(username)
+	if err != nil {
+		return err
+	}
+	if _, err := getChannelById(id); err != nil {
+		return err
+	}
+	index := -1
+	for i, fav := range ids {
+		if fav == id {
+			index = i
+		}
+	}
+
+	switch {
+	case action == "add" && index < 0:
+		ids = append(ids, id)
+	case action == "remove" && index >= 0:
+		ids = append(ids[:index], ids[index+1:]...)
+	case action == "up" && index > 0:
+		ids[index-1], ids[index] = ids[index], ids[index-1]
+	case action == "down" && index >= 0 && index < len(ids)-1:
+		ids[index+1], ids[index] = ids[index], ids[index+1]
+	default:
+		return nil
+	}
+	return setFavourites(username, ids)
+}
+
+func getUserChannels(username, group string, onlyFavourites bool) []Channel {
+	// The favourites of the user come first, in the order chosen, then the rest by number.
+	ids, err := getFavourites(username)
+	if err != nil {
+		logMessage("warn", "Could not get favourite channels", err)
+	}
+	position := make(map[int64]int)
+	for i, id := range ids {
+		position[id] = i
+	}
+
+	var favourites, others []Channel
+	for _, c := range getChannels() {
+		if group != "" && c.Group != group {
+			continue
+		}
+		if _, ok := position[c.Id]; ok {
+			c.Favourite = true
+			favourites = append(favourites, c)
+		} else if !onlyFavourites {
+			others = append(others, c)
+		}
+	}
+	sort.SliceStable(favourites, func(i, j int) bool {
+		return position[favourites[i].Id] < position[favourites[j].Id]
+	})
+	return append(favourites, others...)
+}
+
+func getChannelGroups() []string {
+	seen := make(map[string]bool)
+	var groups []string
+	for _, c := range getChannels() {
+		if c.Group != "" && !seen[c.Group] {
+			seen[c.Group] = true
+			groups = append(groups, c.Group)
+		}
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+func getChannelFilter(r *auth.AuthenticatedRequest) (string, bool, string) {
+	// The group and favourites chosen, and the same as a query to keep in links.
+	group := r.FormValue("group")
+	onlyFavourites := r.FormValue("favourites") != ""
+	q := url.Values{}
+	if group != "" {
+		q.Set("group", group)
+	}
+	if onlyFavourites {
+		q.Set("favourites", "1")
+	}
+	query := ""
+	if len(q) > 0 {
+		query = "&" + q.Encode()
+	}
+	return group, onlyFavourites, query
+}
+
+func favouritesHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	// Only forms may change them, so links and images on other sites can't. The
+	// pages use /api/v1/favourites.
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Ugyldig metode", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Ugyldig kanal", http.StatusBadRequest)
+		return
+	}
+	err = changeFavourite(r.Username, id, r.FormValue("action"))
+	if err != nil {
+		logMessage("warn", fmt.Sprintf("Could not change favourite channel %d", id), err)
+		http.Error(w, "Kunne ikke endre favoritter", http.StatusInternalServerError)
+		return
+	}
+
+	// Back to the page we came from, if it is one of ours. Only the path and
+	// query are used, so it can't lead to another site.
+	back := config.BaseUrl + "settings"
+	u, err := url.Parse(r.Referer())
+	if err == nil && (u.Host == "" || u.Host == r.Host) &&
+		strings.HasPrefix(u.Path, config.BaseUrl) && !strings.HasPrefix(u.Path, "//") {
+		back = u.Path
+		if u.RawQuery != "" {
+			back += "?" + u.RawQuery
+		}
+	}
+	http.Redirect(w, &(r.Request), back, 302)
+}
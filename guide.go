@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	auth "github.com/abbot/go-http-auth"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type GuideCell struct {
+	EPG
+	Left      string
+	Width     string
+	Recording bool
+	Scheduled bool
+}
+
+type GuideRow struct {
+	Channel string
+	Cells   []GuideCell
+}
+
+type GuideTick struct {
+	Label string
+	Left  string
+}
+
+// Hours shown in the guide at once, if not given.
+const defaultGuideHours = 4
+
+func getGuideRows(channels []Channel, from, to time.Time, loc *time.Location) ([]GuideRow, error) {
+	// We'll use the DB, so ensure it is up.
+	ensureDbhConnection()
+
+	// All planned recordings, so we can mark them.
+	planned := make(map[string]bool)
+	rows, err := dbh.Query("SELECT title, channel, start FROM recordings")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var title, channel string
+		var start time.Time
+		err := rows.Scan(&title, &channel, &start)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		planned[fmt.Sprintf("%s\x00%s\x00%d", title, channel, start.Unix())] = true
+	}
+	rows.Close()
+
+	now := time.Now()
+	period := to.Sub(from).Minutes()
+	var guide []GuideRow
+	for _, channel := range channels {
+		// The programmes overlapping the period, in the same channel order as everywhere else.
+		programmes, err := epgCache.Range(channel.Name, from, to)
+		if err != nil {
+			return guide, err
+		}
+
+		row := GuideRow{Channel: channel.Name}
+		for _, epg := range programmes {
+			epg = epg.In(loc)
+
+			// Place the programme relative to the period, cutting what is outside.
+			start, stop := epg.StartTime, epg.StopTime
+			if start.Before(from) {
+				start = from
+			}
+			if stop.After(to) {
+				stop = to
+			}
+			scheduled := planned[fmt.Sprintf("%s\x00%s\x00%d", epg.Title, epg.Channel, epg.StartTime.Unix())]
+			row.Cells = append(row.Cells, GuideCell{
+				EPG:       epg,
+				Left:      fmt.Sprintf("%.3f", start.Sub(from).Minutes()/period*100),
+				Width:     fmt.Sprintf("%.3f", stop.Sub(start).Minutes()/period*100),
+				Scheduled: scheduled,
+				Recording: scheduled && now.After(epg.StartTime) && now.Before(epg.StopTime),
+			})
+		}
+		guide = append(guide, row)
+	}
+	return guide, nil
+}
+
+func getGuideTicks(from, to time.Time) []GuideTick {
+	// A tick each half hour.
+	var ticks []GuideTick
+	period := to.Sub(from).Minutes()
+	for t := from; t.Before(to); t = t.Add(30 * time.Minute) {
+		ticks = append(ticks, GuideTick{
+			Label: t.Format("15:04"),
+			Left:  fmt.Sprintf("%.3f", t.Sub(from).Minutes()/period*100),
+		})
+	}
+	return ticks
+}
+
+func guidePageHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	// Default to the current hour today, where the user is.
+	loc := getUserLocation(r.Username)
+	now := time.Now().In(loc)
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	if d, err := time.ParseInLocation("2006-01-02", r.FormValue("day"), loc); err == nil {
+		day = d
+	}
+	hour := now.Hour()
+	if h, err := strconv.Atoi(r.FormValue("hour")); err == nil && h >= 0 && h < 24 {
+		hour = h
+	}
+	hours := defaultGuideHours
+	if h, err := strconv.Atoi(r.FormValue("hours")); err == nil && h > 0 && h <= 24 {
+		hours = h
+	}
+
+	from := time.Date(day.Year(), day.Month(), day.Day(), hour, 0, 0, 0, loc)
+	to := from.Add(time.Duration(hours) * time.Hour)
+
+	group, onlyFavourites, query := getChannelFilter(r)
+	rows, err := getGuideRows(getUserChannels(r.Username, group, onlyFavourites), from, to, loc)
+	if err != nil {
+		logMessage("warn", "Could not get programme guide", err)
+	}
+
+	// Links to move around in the guide.
+	link := func(t time.Time) string {
+		return fmt.Sprintf("%sguide?day=%s&hour=%d&hours=%d%s", config.BaseUrl, t.Format("2006-01-02"), t.Hour(), hours, query)
+	}
+	var days []map[string]string
+	for i := 0; i < 7; i++ {
+		d := time.Date(now.Year(), now.Month(), now.Day()+i, hour, 0, 0, 0, loc)
+		days = append(days, map[string]string{
+			"Name": getNorwegianWeekday(int(d.Weekday())),
+			"Link": link(d),
+		})
+	}
+
+	// Mark the current time, if it is shown.
+	nowLeft := ""
+	if now.After(from) && now.Before(to) {
+		nowLeft = fmt.Sprintf("%.3f", now.Sub(from).Minutes()/to.Sub(from).Minutes()*100)
+	}
+
+	d := make(map[string]interface{})
+	d["BaseUrl"] = config.BaseUrl
+	d["Title"] = "Programguide"
+	d["User"] = r.Username
+	d["Admin"] = isAdmin(r.Username)
+	d["Rows"] = rows
+	d["Ticks"] = getGuideTicks(from, to)
+	d["Now"] = nowLeft
+	d["Day"] = fmt.Sprintf("%s %s", getNorwegianWeekday(int(from.Weekday())), from.Format("02.01.2006"))
+	d["Days"] = days
+	d["Earlier"] = link(from.Add(-time.Duration(hours) * time.Hour))
+	d["Later"] = link(to)
+	d["Groups"] = getChannelGroups()
+	d["Group"] = group
+	d["OnlyFavourites"] = onlyFavourites
+	d["Hour"] = hour
+	d["Hours"] = hours
+	d["Date"] = from.Format("2006-01-02")
+	d["Current"] = link(time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), 0, 0, 0, loc))
+	w.Write(getPage("guide.html", d))
+}
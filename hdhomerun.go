@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// What we tell media servers like Plex, Jellyfin and Emby we are.
+type HDHomeRunDiscover struct {
+	FriendlyName    string
+	Manufacturer    string
+	ModelNumber     string
+	FirmwareName    string
+	FirmwareVersion string
+	DeviceID        string
+	DeviceAuth      string
+	BaseURL         string
+	LineupURL       string
+	TunerCount      int
+}
+
+type HDHomeRunLineup struct {
+	GuideNumber string
+	GuideName   string
+	URL         string
+}
+
+type HDHomeRunLineupStatus struct {
+	ScanInProgress int
+	ScanPossible   int
+	Source         string
+	SourceList     []string
+}
+
+// Tuners in use, which may not be more than configured.
+var tunersInUse int
+var tunerLock sync.Mutex
+
+func getDeviceId() string {
+	// Stable for the host, unless configured.
+	if config.HDHomeRunDeviceId != "" {
+		return config.HDHomeRunDeviceId
+	}
+	return fmt.Sprintf("%08X", crc32.ChecksumIEEE([]byte("teve:"+config.Hostname)))
+}
+
+func acquireTuner() bool {
+	tunerLock.Lock()
+	defer tunerLock.Unlock()
+	if tunersInUse >= config.HDHomeRunTuners {
+		return false
+	}
+	tunersInUse += 1
+	return true
+}
+
+func releaseTuner() {
+	tunerLock.Lock()
+	tunersInUse -= 1
+	tunerLock.Unlock()
+}
+
+func hdhomerunHandler(w http.ResponseWriter, r *http.Request) {
+	if config.HDHomeRunTuners <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Media servers can't do basic auth, so the token of the user is in the path:
+	// /hdhomerun/{token}/discover.json
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/hdhomerun/"), "/", 2)
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	username, err := getUserFromToken(parts[0])
+	if err != nil {
+		http.Error(w, "Ugyldig nøkkel", http.StatusForbidden)
+		return
+	}
+	base := getExternalUrl("hdhomerun/" + parts[0])
+
+	switch {
+	case parts[1] == "discover.json" || parts[1] == "":
+		writeJSON(w, http.StatusOK, HDHomeRunDiscover{
+			FriendlyName:    "teve",
+			Manufacturer:    "Silicondust",
+			ModelNumber:     "HDTC-2US",
+			FirmwareName:    "hdhomeruntc_atsc",
+			FirmwareVersion: "20150826",
+			DeviceID:        getDeviceId(),
+			BaseURL:         base,
+			LineupURL:       base + "/lineup.json",
+			TunerCount:      config.HDHomeRunTuners,
+		})
+	case parts[1] == "lineup.json":
+		// In the order of the user, and only channels we can play.
+		lineup := []HDHomeRunLineup{}
+		numbers := getGuideNumbers()
+		for _, c := range getUserChannels(username, "", false) {
+			if len(c.Sources()) == 0 {
+				continue
+			}
+			lineup = append(lineup, HDHomeRunLineup{
+				GuideNumber: strconv.Itoa(numbers[c.Id]),
+				GuideName:   c.Name,
+				URL:         fmt.Sprintf("%s/auto/v%d", base, numbers[c.Id]),
+			})
+		}
+		writeJSON(w, http.StatusOK, lineup)
+	case parts[1] == "lineup_status.json":
+		writeJSON(w, http.StatusOK, HDHomeRunLineupStatus{
+			ScanInProgress: 0,
+			ScanPossible:   1,
+			Source:         "Cable",
+			SourceList:     []string{"Cable"},
+		})
+	case parts[1] == "lineup.post":
+		// The channels are changed in teve, so there is nothing to scan.
+		w.WriteHeader(http.StatusOK)
+	case parts[1] == "device.xml":
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprintf(w, `<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <URLBase>%s</URLBase>
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:MediaServer:1</deviceType>
+    <friendlyName>teve</friendlyName>
+    <manufacturer>Silicondust</manufacturer>
+    <modelName>HDTC-2US</modelName>
+    <modelNumber>HDTC-2US</modelNumber>
+    <serialNumber></serialNumber>
+    <UDN>uuid:%s</UDN>
+  </device>
+</root>
+`, base, getDeviceId())
+	case strings.HasPrefix(parts[1], "auto/v"):
+		tuneHDHomeRun(w, r, username, strings.TrimPrefix(parts[1], "auto/v"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func getGuideNumbers() map[int64]int {
+	// The number of each channel, unless it has none or shares it with a channel
+	// before it. Those get their id, or the first number free after it.
+	channels := getChannels()
+	numbers := make(map[int64]int)
+	used := make(map[int]bool)
+	for _, c := range channels {
+		if c.Number > 0 && !used[c.Number] {
+			numbers[c.Id] = c.Number
+			used[c.Number] = true
+		}
+	}
+	for _, c := range channels {
+		if _, ok := numbers[c.Id]; ok {
+			continue
+		}
+		n := int(c.Id)
+		for used[n] {
+			n += 1
+		}
+		numbers[c.Id] = n
+		used[n] = true
+	}
+	return numbers
+}
+
+func tuneHDHomeRun(w http.ResponseWriter, r *http.Request, username, number string) {
+	var channel *Channel
+	numbers := getGuideNumbers()
+	for _, c := range getChannels() {
+		if strconv.Itoa(numbers[c.Id]) == number && len(c.Sources()) > 0 {
+			channel = &c
+			break
+		}
+	}
+	if channel == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// A HDHomeRun with all tuners busy answers like this.
+	if !acquireTuner() {
+		w.Header().Set("X-HDHomeRun-Error", "805 All Tuners In Use")
+		http.Error(w, "All tuners in use", http.StatusServiceUnavailable)
+		return
+	}
+	defer releaseTuner()
+	logMessage("info", fmt.Sprintf("Tuner started '%s' for '%s'", channel.Name, username), nil)
+
+	// The stream goes through the same failover as our other streams, directly
+	// to the media server until it hangs up.
+	pr, pw := io.Pipe()
+	runFeeder(r, pw, "tuner:"+username, *channel)
+	defer stopFeeder(r)
+	go func() {
+		// Also when no source gives any data to notice the hang up with.
+		<-r.Context().Done()
+		pr.Close()
+	}()
+
+	w.Header().Set("Content-Type", "video/mp2t")
+	w.WriteHeader(http.StatusOK)
+	_, err := io.Copy(w, pr)
+	pr.Close()
+	logMessage("info", fmt.Sprintf("Tuner stopped '%s' for '%s'", channel.Name, username), err)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// How long the DB may take to answer, so the checks never hang.
+const healthTimeout = 2 * time.Second
+
+// Hours since the last EPG import before the EPG is too old, unless twice the
+// import interval is longer.
+const defaultEpgMaxAge = 48
+
+// The result of checking a part of teve. Status is ok, warn or fail, where
+// only fail makes teve not ready.
+type HealthCheck struct {
+	Status  string
+	Message string `json:",omitempty"`
+}
+
+type HealthStatus struct {
+	Status string
+	Checks map[string]HealthCheck
+}
+
+func healthOk(format string, a ...interface{}) HealthCheck {
+	return HealthCheck{"ok", fmt.Sprintf(format, a...)}
+}
+
+func healthWarn(format string, a ...interface{}) HealthCheck {
+	return HealthCheck{"warn", fmt.Sprintf(format, a...)}
+}
+
+func healthFail(format string, a ...interface{}) HealthCheck {
+	return HealthCheck{"fail", fmt.Sprintf(format, a...)}
+}
+
+func checkDatabase(ctx context.Context) HealthCheck {
+	// Pinged directly, since ensureDbhConnection waits until the DB is up.
+	if dbh == nil {
+		return healthFail("Not connected")
+	}
+	err := dbh.PingContext(ctx)
+	if err != nil {
+		return healthFail("%v", err)
+	}
+	return healthOk("")
+}
+
+func checkCubemap() HealthCheck {
+	pid, err := getPid("cubemap")
+	if err != nil {
+		return healthFail("Cubemap is not running")
+	}
+	return healthOk("Running as PID %d", pid)
+}
+
+func checkRecordingsFolder() HealthCheck {
+	// Write a file, as the recordings will.
+	file, err := ioutil.TempFile(config.RecordingsFolder, ".teve-health-")
+	if err != nil {
+		return healthFail("Not writable: %v", err)
+	}
+	file.Close()
+	os.Remove(file.Name())
+
+	free, _, err := getDiskSpace()
+	if err != nil {
+		return healthFail("Could not check free space: %v", err)
+	}
+	warning := uint64(defaultDiskSpaceWarning)
+	if config.DiskSpaceWarning > 0 {
+		warning = uint64(config.DiskSpaceWarning)
+	}
+	if free/1000000 < warning {
+		return healthWarn("Only %d MB free", free/1000000)
+	}
+	return healthOk("%d MB free", free/1000000)
+}
+
+func checkEpg(ctx context.Context) HealthCheck {
+	var last pq.NullTime
+	err := dbh.QueryRowContext(ctx, "SELECT max(finished) FROM epg_imports WHERE error = ''").Scan(&last)
+	if err != nil && err != sql.ErrNoRows {
+		return healthFail("%v", err)
+	}
+	if !last.Valid {
+		return healthWarn("No EPG has been imported")
+	}
+
+	maxAge := time.Duration(defaultEpgMaxAge) * time.Hour
+	if interval := time.Duration(2*config.EPGImportInterval) * time.Hour; interval > maxAge {
+		maxAge = interval
+	}
+	age := time.Since(last.Time)
+	if age > maxAge {
+		return healthFail("Last imported %v ago", age.Truncate(time.Minute))
+	}
+	return healthOk("Last imported %v ago", age.Truncate(time.Minute))
+}
+
+func checkScheduler() HealthCheck {
+	// The scheduler is stuck if a check is overdue by a whole interval.
+	status := getSchedulerStatus()
+	if status.NextRun.IsZero() {
+		return healthOk("Not yet run")
+	}
+	if time.Since(status.NextRun) > getSubscriptionInterval() {
+		return healthFail("Last ran %v", status.LastRun.Format(time.RFC3339))
+	}
+	if status.LastError != "" && status.LastErrorTime.After(status.LastRun) {
+		return healthWarn("%s", status.LastError)
+	}
+	return healthOk("Last ran %v", status.LastRun.Format(time.RFC3339))
+}
+
+func checkFailover() HealthCheck {
+	// A VLC playing from a backup source still works, but someone should look
+	// at the primary.
+	var backup []string
+	feeds := getFailoverStatus().Feeds
+	for _, feed := range feeds {
+		if !feed.Primary {
+			backup = append(backup, fmt.Sprintf("%s from %s", feed.Channel, feed.Source))
+		}
+	}
+	if len(backup) > 0 {
+		return healthWarn("Playing from backup: %s", strings.Join(backup, ", "))
+	}
+	return healthOk("%d feeds on their primary source", len(feeds))
+}
+
+func writeHealth(w http.ResponseWriter, checks map[string]HealthCheck) {
+	health := HealthStatus{"ok", checks}
+	for _, check := range checks {
+		if check.Status == "fail" {
+			health.Status = "fail"
+		}
+	}
+	status := http.StatusOK
+	if health.Status == "fail" {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, health)
+}
+
+// Whether teve is alive, i.e. should not be restarted. Only the process
+// answering, since restarting would not bring back the DB or the EPG.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, map[string]HealthCheck{})
+}
+
+// Whether teve can serve users, with all it depends on.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthTimeout)
+	defer cancel()
+
+	checks := map[string]HealthCheck{
+		"database":   checkDatabase(ctx),
+		"recordings": checkRecordingsFolder(),
+		"scheduler":  checkScheduler(),
+		"failover":   checkFailover(),
+	}
+	if config.CubemapConfig != "" {
+		checks["cubemap"] = checkCubemap()
+	}
+	// The EPG is in the DB, so there is no use asking if it is down.
+	if checks["database"].Status == "ok" {
+		checks["epg"] = checkEpg(ctx)
+	} else {
+		checks["epg"] = healthFail("The database is down")
+	}
+	writeHealth(w, checks)
+}
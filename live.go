@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	auth "github.com/abbot/go-http-auth"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How often the state is checked for changes, and how long a connection may
+// be quiet before proxies are reminded that it is alive.
+const liveInterval = 5 * time.Second
+const liveKeepAlive = 30 * time.Second
+
+// What the index page shows and keeps up to date, as sent to the page.
+type LiveState struct {
+	Playing     string
+	Transcoding int
+	Viewers     int
+	Recordings  []LiveRecording
+	// The upcoming programmes of each channel shown.
+	Channels map[string][]EPG
+}
+
+type LiveRecording struct {
+	Recording
+	// Whether VLC is recording, and how much of the programme it has.
+	Running bool
+	Percent int
+}
+
+// The connections waiting for changes, woken by notifyLive.
+var liveClients = make(map[chan bool]bool)
+var liveLock sync.Mutex
+
+func notifyLive() {
+	// Wake every connection, unless it is already awake.
+	liveLock.Lock()
+	defer liveLock.Unlock()
+	for c := range liveClients {
+		select {
+		case c <- true:
+		default:
+		}
+	}
+}
+
+// The viewers of each stream, counted once for all the connections, as
+// counting runs lsof.
+var viewerCounts = make(map[string]int)
+var viewersCounted time.Time
+var viewersLock sync.Mutex
+
+func getViewerCount(user User) int {
+	viewersLock.Lock()
+	defer viewersLock.Unlock()
+	if time.Since(viewersCounted) >= liveInterval {
+		viewerCounts = make(map[string]int)
+		for name, stream := range getStreams() {
+			u, err := getUserFromName(name)
+			if err != nil || stream.Pid == 0 {
+				continue
+			}
+			viewerCounts[name], _ = strconv.Atoi(countStream(stream.Pid, u))
+		}
+		viewersCounted = time.Now()
+	}
+	return viewerCounts[user.Name]
+}
+
+func getLiveRecordings(loc *time.Location) []LiveRecording {
+	now := time.Now()
+	var live []LiveRecording
+	for _, recording := range getRecordings() {
+		r := LiveRecording{Recording: recording.In(loc), Running: recording.Pid != 0}
+		length := recording.StopTime.Sub(recording.StartTime)
+		if r.Running && length > 0 {
+			r.Percent = int(now.Sub(recording.StartTime) * 100 / length)
+			if r.Percent > 100 {
+				r.Percent = 100
+			}
+		}
+		live = append(live, r)
+	}
+	sort.Slice(live, func(i, j int) bool {
+		return live[i].StartTime.Before(live[j].StartTime)
+	})
+	return live
+}
+
+func getLiveState(user User, channels []Channel, numEpg int, category string, loc *time.Location) LiveState {
+	state := LiveState{
+		Recordings: getLiveRecordings(loc),
+		Channels:   make(map[string][]EPG),
+	}
+	if stream, ok := getStream(user.Name); ok {
+		state.Playing = stream.Name
+		state.Transcoding = stream.Transcode
+		state.Viewers = getViewerCount(user)
+	}
+	for _, channel := range getChannelsWithEpg(channels, numEpg, category, loc) {
+		state.Channels[channel.Name] = channel.EPGlist
+	}
+	return state
+}
+
+// Sends the state of the index page as Server-Sent Events, each time it
+// changes. The page gives its own query, so the same channels are shown.
+func liveHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	user, err := getUserFromRequest(r)
+	if err != nil {
+		http.Error(w, "Ukjent bruker", http.StatusForbidden)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Strømming støttes ikke", http.StatusInternalServerError)
+		return
+	}
+
+	// The same choices as on the page.
+	numEpg, err := strconv.Atoi(r.FormValue("num"))
+	if err != nil {
+		numEpg = 3
+	}
+	category := r.FormValue("category")
+	loc := getUserLocation(user.Name)
+	group, onlyFavourites, _ := getChannelFilter(r)
+	channels := getUserChannels(user.Name, group, onlyFavourites)
+
+	wake := make(chan bool, 1)
+	liveLock.Lock()
+	liveClients[wake] = true
+	liveLock.Unlock()
+	defer func() {
+		liveLock.Lock()
+		delete(liveClients, wake)
+		liveLock.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stop nginx from buffering the events.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(liveInterval)
+	defer ticker.Stop()
+	var last []byte
+	sent := time.Now()
+	for {
+		state := getLiveState(user, channels, numEpg, category, loc)
+		data, err := json.Marshal(state)
+		if err != nil {
+			logMessage("warn", "Could not encode live state", err)
+		} else if string(data) != string(last) {
+			last = data
+			sent = time.Now()
+			fmt.Fprintf(w, "event: state\ndata: %s\n\n", data)
+			flusher.Flush()
+		} else if time.Since(sent) > liveKeepAlive {
+			sent = time.Now()
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-wake:
+		case <-ticker.C:
+		}
+	}
+}
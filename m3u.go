@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	auth "github.com/abbot/go-http-auth"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Matches the attributes of an #EXTINF-line, e.g. tvg-id="nrk1.no".
+var extinfAttribute = regexp.MustCompile(`([A-Za-z0-9_-]+)="([^"]*)"`)
+
+// How long to wait for VLC to listen, when tuning a channel for a player.
+const tuneTimeout = 10 * time.Second
+
+func parseExtinf(line string) (map[string]string, string) {
+	// The name is what follows the first comma that is not within quotes.
+	info := strings.TrimPrefix(line, "#EXTINF:")
+	quoted := false
+	name := ""
+	for i, c := range info {
+		if c == '"' {
+			quoted = !quoted
+		} else if c == ',' && !quoted {
+			name = strings.TrimSpace(info[i+1:])
+			info = info[:i]
+			break
+		}
+	}
+	attrs := make(map[string]string)
+	for _, m := range extinfAttribute.FindAllStringSubmatch(info, -1) {
+		attrs[strings.ToLower(m[1])] = strings.TrimSpace(m[2])
+	}
+	return attrs, name
+}
+
+func parseM3U(r io.Reader) ([]Channel, error) {
+	var channels []Channel
+	var current *Channel
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#EXTM3U"):
+		case strings.HasPrefix(line, "#EXTINF:"):
+			attrs, name := parseExtinf(line)
+			if name == "" {
+				name = attrs["tvg-name"]
+			}
+			c := Channel{
+				Name:  name,
+				EPGId: attrs["tvg-id"],
+				Logo:  attrs["tvg-logo"],
+				Group: attrs["group-title"],
+			}
+			c.Number, _ = strconv.Atoi(attrs["tvg-chno"])
+			current = &c
+		case strings.HasPrefix(line, "#EXTGRP:"):
+			if current != nil && current.Group == "" {
+				current.Group = strings.TrimSpace(strings.TrimPrefix(line, "#EXTGRP:"))
+			}
+		case strings.HasPrefix(line, "#"):
+			// Options for players, which we don't need.
+		default:
+			// The address of the entry above.
+			if current != nil && current.Name != "" {
+				current.Address = line
+				channels = append(channels, *current)
+			}
+			current = nil
+		}
+	}
+	return channels, scanner.Err()
+}
+
+func truncateName(name string) string {
+	// Names are at most 30 characters in the DB.
+	runes := []rune(strings.TrimSpace(name))
+	if len(runes) > 30 {
+		runes = runes[:30]
+	}
+	return string(runes)
+}
+
+func importM3U(entries []Channel) (int, int, error) {
+	existing := make(map[string]Channel)
+	last := 0
+	for _, c := range getChannels() {
+		existing[c.Name] = c
+		if c.Number > last {
+			last = c.Number
+		}
+	}
+
+	// Channels we have are updated, and the others are added after the last one.
+	added, updated := 0, 0
+	for _, entry := range entries {
+		entry.Name = truncateName(entry.Name)
+		c, ok := existing[entry.Name]
+		if ok {
+			c.Address = entry.Address
+			if entry.EPGId != "" {
+				c.EPGId = entry.EPGId
+			}
+			if entry.Logo != "" {
+				c.Logo = entry.Logo
+			}
+			if entry.Group != "" {
+				c.Group = entry.Group
+			}
+			if entry.Number > 0 {
+				c.Number = entry.Number
+			}
+			updated += 1
+		} else {
+			c = entry
+			if c.Number == 0 {
+				last += 1
+				c.Number = last
+			}
+			added += 1
+		}
+		c, err := saveChannel(c)
+		if err != nil {
+			return added, updated, fmt.Errorf("%s: %v", entry.Name, err)
+		}
+		existing[c.Name] = c
+	}
+	return added, updated, nil
+}
+
+func channelsImportHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	if !isAdmin(r.Username) {
+		http.Error(w, "Bare administratorer har tilgang", http.StatusForbidden)
+		return
+	}
+
+	// The playlist is either uploaded, or fetched from the provider.
+	var playlist io.ReadCloser
+	if file, _, err := r.FormFile("file"); err == nil {
+		playlist = file
+	} else if source := r.FormValue("url"); source != "" {
+		// Only from the web, as anything else would be a file on the server.
+		if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+			http.Error(w, "Adressen må begynne med http:// eller https://", http.StatusBadRequest)
+			return
+		}
+		rc, err := openEpgSource(source)
+		if err != nil {
+			logMessage("warn", "Could not fetch M3U playlist", err)
+			http.Error(w, "Kunne ikke hente spillelisten", http.StatusBadRequest)
+			return
+		}
+		playlist = rc
+	} else {
+		http.Error(w, "Mangler spilleliste", http.StatusBadRequest)
+		return
+	}
+	defer playlist.Close()
+
+	entries, err := parseM3U(playlist)
+	if err != nil {
+		logMessage("warn", "Could not parse M3U playlist", err)
+		http.Error(w, "Ugyldig spilleliste", http.StatusBadRequest)
+		return
+	}
+	added, updated, err := importM3U(entries)
+	message := fmt.Sprintf("La til %d og oppdaterte %d kanaler.", added, updated)
+	if err != nil {
+		logMessage("warn", "Could not import M3U playlist", err)
+		message += " Feil: " + err.Error()
+	}
+	logMessage("info", fmt.Sprintf("Imported M3U playlist, %d channels added and %d updated", added, updated), nil)
+
+	if r.FormValue("format") == "json" {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"Added": added, "Updated": updated, "Message": message})
+		return
+	}
+	http.Redirect(w, &(r.Request), config.BaseUrl+"admin/channels?message="+url.QueryEscape(message), 302)
+}
+
+func getPlaylistToken(username string, renew bool) (string, error) {
+	// We'll use the DB, so ensure it is up.
+	ensureDbhConnection()
+
+	var token string
+	err := dbh.QueryRow("SELECT coalesce(playlist_token, '') FROM user_settings WHERE username = $1", username).Scan(&token)
+	if err == nil && token != "" && !renew {
+		return token, nil
+	}
+
+	// A random token, which players use instead of the password.
+	b := make([]byte, 16)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	token = hex.EncodeToString(b)
+	_, err = dbh.Exec(`INSERT INTO user_settings(username, playlist_token) VALUES ($1, $2)
+                     ON CONFLICT (username) DO UPDATE SET playlist_token = EXCLUDED.playlist_token`, username, token)
+	return token, err
+}
+
+func getUserFromToken(token string) (string, error) {
+	// We'll use the DB, so ensure it is up.
+	ensureDbhConnection()
+
+	var username string
+	err := dbh.QueryRow("SELECT username FROM user_settings WHERE playlist_token = $1", token).Scan(&username)
+	return username, err
+}
+
+func tokenAuth(authenticator *auth.BasicAuth, handler auth.AuthenticatedHandlerFunc) http.HandlerFunc {
+	// Players can't always do basic auth, so they may give the token of the user instead.
+	basic := authenticator.Wrap(handler)
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			basic(w, r)
+			return
+		}
+		username, err := getUserFromToken(token)
+		if err != nil {
+			http.Error(w, "Ugyldig nøkkel", http.StatusForbidden)
+			return
+		}
+		handler(w, &auth.AuthenticatedRequest{Request: *r, Username: username})
+	}
+}
+
+func getExternalUrl(path string) string {
+	// Without debug we are behind a proxy, on the standard port.
+	port := ""
+	if config.Debug {
+		port = ":" + config.WebPort
+	}
+	return fmt.Sprintf("http://%s%s%s%s", config.Hostname, port, config.BaseUrl, path)
+}
+
+func playlistHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	token, err := getPlaylistToken(r.Username, false)
+	if err != nil {
+		logMessage("warn", "Could not get playlist token", err)
+		http.Error(w, "Kunne ikke lage spilleliste", http.StatusInternalServerError)
+		return
+	}
+
+	// Each entry tunes the channel for the user, and the guide is our own export.
+	var buf bytes.Buffer
+	group, onlyFavourites, query := getChannelFilter(r)
+	q := url.Values{"token": {token}}
+	fmt.Fprintf(&buf, "#EXTM3U url-tvg=\"%s\"\n", getExternalUrl("xmltv?"+q.Encode()+query))
+	for _, c := range getUserChannels(r.Username, group, onlyFavourites) {
+		if c.Address == "" {
+			continue
+		}
+		q := url.Values{"token": {token}, "channel": {c.Name}}
+		if transcoding := r.FormValue("transcoding"); transcoding != "" {
+			q.Set("transcoding", transcoding)
+		}
+		fmt.Fprintf(&buf, "#EXTINF:-1 tvg-id=\"%s\" tvg-name=\"%s\" tvg-chno=\"%d\" tvg-logo=\"%s\" group-title=\"%s\",%s\n",
+			m3uEscape(c.Name), m3uEscape(c.Name), c.Number, m3uEscape(c.Logo), m3uEscape(c.Group), c.Name)
+		fmt.Fprintf(&buf, "%s\n", getExternalUrl("tune?"+q.Encode()))
+	}
+
+	w.Header().Set("Content-Type", "audio/x-mpegurl; charset=utf-8")
+	w.Header().Set("Content-Disposition", "inline; filename=teve.m3u")
+	w.Write(buf.Bytes())
+}
+
+func m3uEscape(s string) string {
+	// Attributes can't hold quotes, and entries can't span lines.
+	return strings.NewReplacer(`"`, "'", "\n", " ", "\r", " ").Replace(s)
+}
+
+func waitForStream(user User) {
+	// VLC takes a moment to listen, and players give up if they are refused.
+	if config.CubemapConfig != "" {
+		return
+	}
+	address := fmt.Sprintf("localhost:%d", getUserPort(user))
+	deadline := time.Now().Add(tuneTimeout)
+	for time.Now().Before(deadline) {
+		conn, err := net.DialTimeout("tcp", address, time.Second)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+func tuneHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	user, err := getUserFromRequest(r)
+	if err != nil {
+		http.Error(w, "Ukjent bruker", http.StatusForbidden)
+		return
+	}
+	channel, err := getChannel(r.FormValue("channel"), "")
+	if err != nil {
+		http.Error(w, "Ukjent kanal", http.StatusNotFound)
+		return
+	}
+
+	// Only start the channel if the user isn't already watching it.
+	transcoding := getTranscoding(r.FormValue("transcoding"))
+	if stream, ok := getStream(user.Name); !ok || stream.Name != channel.Name || stream.Transcode != transcoding {
+		err = startChannel(*channel, user, transcoding)
+		if err != nil {
+			logMessage("warn", "Could not tune channel", err)
+			http.Error(w, "Kunne ikke starte kanalen", http.StatusInternalServerError)
+			return
+		}
+		waitForStream(user)
+	}
+	http.Redirect(w, &(r.Request), getUserURL(user), 302)
+}
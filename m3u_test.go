@@ -0,0 +1,55 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseExtinf(t *testing.T) {
+	tests := []struct {
+		line  string
+		attrs map[string]string
+		name  string
+	}{
+		{"#EXTINF:-1,NRK1", map[string]string{}, "NRK1"},
+		{`#EXTINF:-1 tvg-id="nrk1.nrk.no" tvg-chno="1" group-title="NRK",NRK1 HD`,
+			map[string]string{"tvg-id": "nrk1.nrk.no", "tvg-chno": "1", "group-title": "NRK"}, "NRK1 HD"},
+		// Commas within quotes are not the start of the name.
+		{`#EXTINF:-1 tvg-name="Sport, Fotball" TVG-LOGO="http://example.com/a,b.png",`,
+			map[string]string{"tvg-name": "Sport, Fotball", "tvg-logo": "http://example.com/a,b.png"}, ""},
+		{"#EXTINF:-1", map[string]string{}, ""},
+	}
+	for _, test := range tests {
+		attrs, name := parseExtinf(test.line)
+		if !reflect.DeepEqual(attrs, test.attrs) || name != test.name {
+			t.Errorf("parseExtinf(%q) = %v, %q, want %v, %q", test.line, attrs, name, test.attrs, test.name)
+		}
+	}
+}
+
+func TestParseM3U(t *testing.T) {
+	playlist := `#EXTM3U
+#EXTINF:-1 tvg-id="nrk1.nrk.no" tvg-chno="1" tvg-logo="http://example.com/nrk1.png" group-title="NRK",NRK1
+udp://@239.0.0.1:1234
+
+#EXTINF:-1 tvg-name="TV 2",
+#EXTGRP:TV 2
+#EXTVLCOPT:network-caching=1000
+http://example.com/tv2.m3u8
+#EXTINF:-1,
+http://example.com/nameless.m3u8
+http://example.com/without-extinf.m3u8
+`
+	channels, err := parseM3U(strings.NewReader(playlist))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Channel{
+		{Name: "NRK1", Number: 1, EPGId: "nrk1.nrk.no", Logo: "http://example.com/nrk1.png", Group: "NRK", Address: "udp://@239.0.0.1:1234"},
+		{Name: "TV 2", Group: "TV 2", Address: "http://example.com/tv2.m3u8"},
+	}
+	if !reflect.DeepEqual(channels, want) {
+		t.Errorf("parseM3U = %+v, want %+v", channels, want)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Writes metrics in the text format of Prometheus.
+type metricsWriter struct {
+	buf bytes.Buffer
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (m *metricsWriter) describe(name, kind, help string) {
+	fmt.Fprintf(&m.buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (m *metricsWriter) sample(name string, value float64, labels ...string) {
+	// The labels are given as name and value after each other.
+	m.buf.WriteString(name)
+	if len(labels) > 0 {
+		var pairs []string
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1])))
+		}
+		m.buf.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	m.buf.WriteString(" " + strconv.FormatFloat(value, 'g', -1, 64) + "\n")
+}
+
+func (m *metricsWriter) single(name, kind, help string, value float64) {
+	m.describe(name, kind, help)
+	m.sample(name, value)
+}
+
+func metricsAllowed(r *http.Request) bool {
+	// Open to all unless a token is configured, given as a bearer token or in the query.
+	if config.MetricsToken == "" {
+		return true
+	}
+	token := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(config.MetricsToken)) == 1
+}
+
+func writeStreamMetrics(m *metricsWriter) {
+	// By channel and transcoding, which is the profile of the stream.
+	type profile struct {
+		channel     string
+		transcoding int
+	}
+	counts := make(map[profile]int)
+	m.describe("teve_stream_viewers", "gauge", "Viewers of the stream of each user.")
+	running := getStreams()
+	var users []string
+	for name := range running {
+		users = append(users, name)
+	}
+	sort.Strings(users)
+	for _, name := range users {
+		stream := running[name]
+		counts[profile{stream.Name, stream.Transcode}] += 1
+		user, err := getUserFromName(name)
+		if err != nil || stream.Pid == 0 {
+			continue
+		}
+		viewers, _ := strconv.Atoi(countStream(stream.Pid, user))
+		m.sample("teve_stream_viewers", float64(viewers), "user", name, "channel", stream.Name)
+	}
+	m.describe("teve_streams", "gauge", "Streams running, by channel and transcoding in kbit/s.")
+	for p, n := range counts {
+		m.sample("teve_streams", float64(n), "channel", p.channel, "transcoding", strconv.Itoa(p.transcoding))
+	}
+}
+
+func writeRecordingMetrics(m *metricsWriter) {
+	running, scheduled := 0, 0
+	for _, recording := range getRecordings() {
+		if recording.Pid != 0 {
+			running += 1
+		} else {
+			scheduled += 1
+		}
+	}
+	m.describe("teve_recordings", "gauge", "Planned recordings, by whether they are running or yet to start.")
+	m.sample("teve_recordings", float64(running), "state", "running")
+	m.sample("teve_recordings", float64(scheduled), "state", "scheduled")
+
+	counts := getEventCounts()
+	m.single("teve_recordings_failed_total", "counter", "Recordings which could not start.", float64(counts[EventRecordingFailed]))
+	m.describe("teve_events_total", "counter", "Events, by type.")
+	for _, t := range eventTypes {
+		m.sample("teve_events_total", float64(counts[t.Type]), "type", t.Type)
+	}
+
+	status := getFailoverStatus()
+	m.single("teve_vlc_restarts_total", "counter", "VLCs started again for a source of a channel.", float64(status.Restarts))
+	m.single("teve_failovers_total", "counter", "Switches between the sources of a channel.", float64(status.Failovers))
+}
+
+func writeEpgMetrics(m *metricsWriter) {
+	programmes, last, err := getEpgStats()
+	if err != nil {
+		logMessage("warn", "Could not get EPG stats for metrics", err)
+		return
+	}
+	m.single("teve_epg_programmes", "gauge", "Programmes in the EPG.", float64(programmes))
+	if !last.IsZero() {
+		m.single("teve_epg_last_import_timestamp_seconds", "gauge", "When an EPG import last succeeded.", float64(last.Unix()))
+		m.single("teve_epg_import_age_seconds", "gauge", "Seconds since an EPG import last succeeded.", time.Since(last).Seconds())
+	}
+}
+
+func writeSchedulerMetrics(m *metricsWriter) {
+	status := getSchedulerStatus()
+	m.single("teve_subscription_checks_total", "counter", "Checks of the subscriptions.", float64(status.Runs))
+	m.single("teve_subscription_check_duration_seconds", "gauge", "How long the last check of the subscriptions took.", status.LastDuration.Seconds())
+	if !status.LastRun.IsZero() {
+		m.single("teve_subscription_last_check_timestamp_seconds", "gauge", "When the subscriptions were last checked.", float64(status.LastRun.Unix()))
+	}
+}
+
+func writeDiskMetrics(m *metricsWriter) {
+	free, size, err := getDiskSpace()
+	if err == nil {
+		m.single("teve_recordings_disk_free_bytes", "gauge", "Bytes free for the recordings.", float64(free))
+		m.single("teve_recordings_disk_size_bytes", "gauge", "Size of the disk of the recordings.", float64(size))
+	} else {
+		logMessage("warn", "Could not check free disk space", err)
+	}
+	files, err := ioutil.ReadDir(config.RecordingsFolder)
+	if err != nil {
+		logMessage("warn", "Could not list archive for metrics", err)
+		return
+	}
+	var used int64
+	for _, file := range files {
+		used += file.Size()
+	}
+	m.single("teve_recordings_folder_bytes", "gauge", "Bytes used by the recordings in the archive.", float64(used))
+	m.single("teve_recordings_folder_files", "gauge", "Recordings in the archive.", float64(len(files)))
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if !metricsAllowed(r) {
+		http.Error(w, "Ugyldig nøkkel", http.StatusUnauthorized)
+		return
+	}
+
+	m := &metricsWriter{}
+	writeStreamMetrics(m)
+	writeRecordingMetrics(m)
+	writeEpgMetrics(m)
+	writeSchedulerMetrics(m)
+	writeDiskMetrics(m)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(m.buf.Bytes())
+}
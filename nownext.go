@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	auth "github.com/abbot/go-http-auth"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type NowNextProgramme struct {
+	EPG
+	// The start and stop with date and offset, for clients.
+	Begin time.Time
+	End   time.Time
+	// How much of the programme has been shown, from 0 to 100.
+	Percent int
+}
+
+type NowNextChannel struct {
+	Channel string
+	// Whether the stream of the user is playing this channel.
+	Playing bool
+	Now     *NowNextProgramme
+	Next    *NowNextProgramme
+}
+
+type NowNext struct {
+	StreamURL string
+	Channels  []NowNextChannel
+}
+
+func getNowNextProgramme(epg EPG, now time.Time, loc *time.Location) *NowNextProgramme {
+	p := &NowNextProgramme{
+		EPG:   epg.In(loc),
+		Begin: epg.StartTime.In(loc),
+		End:   epg.StopTime.In(loc),
+	}
+	length := epg.StopTime.Sub(epg.StartTime)
+	if length > 0 && now.After(epg.StartTime) {
+		p.Percent = int(now.Sub(epg.StartTime) * 100 / length)
+		if p.Percent > 100 {
+			p.Percent = 100
+		}
+	}
+	return p
+}
+
+func getNowNext(user User, loc *time.Location) NowNext {
+	playing := ""
+	if stream, ok := getStream(user.Name); ok {
+		playing = stream.Name
+	}
+
+	// What is on now and next, from the cache. There may be a gap before the next.
+	now := time.Now()
+	nn := NowNext{StreamURL: getUserURL(user)}
+	for _, channel := range getUserChannels(user.Name, "", false) {
+		c := NowNextChannel{Channel: channel.Name, Playing: channel.Name == playing}
+		for _, epg := range epgCache.Upcoming(channel.Name, 2, nil) {
+			p := getNowNextProgramme(epg, now, loc)
+			if c.Now == nil && c.Next == nil && !epg.StartTime.After(now) {
+				c.Now = p
+			} else if c.Next == nil {
+				c.Next = p
+			}
+		}
+		nn.Channels = append(nn.Channels, c)
+	}
+	return nn
+}
+
+func getNowNextEtag(nn NowNext) (string, error) {
+	// Without the percents, which change every few seconds on some channel, so
+	// the tag only changes with the programmes and what is playing. Clients
+	// follow the progress with Begin and End.
+	channels := make([]NowNextChannel, len(nn.Channels))
+	for i, c := range nn.Channels {
+		if c.Now != nil {
+			now := *c.Now
+			now.Percent = 0
+			c.Now = &now
+		}
+		if c.Next != nil {
+			next := *c.Next
+			next.Percent = 0
+			c.Next = &next
+		}
+		channels[i] = c
+	}
+	nn.Channels = channels
+	data, err := json.Marshal(nn)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(`"%x"`, sha1.Sum(data)), nil
+}
+
+func etagMatches(header, etag string) bool {
+	// The header may list several tags, and weak ones are just as good to us.
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag || tag == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func nowNextHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	user, err := getUserFromRequest(r)
+	if err != nil {
+		http.Error(w, "Ukjent bruker", http.StatusForbidden)
+		return
+	}
+	nn := getNowNext(user, getUserLocation(user.Name))
+	body, err := json.Marshal(nn)
+	var etag string
+	if err == nil {
+		etag, err = getNowNextEtag(nn)
+	}
+	if err != nil {
+		logMessage("warn", "Could not encode now and next", err)
+		http.Error(w, "Kunne ikke hente EPG-data", http.StatusInternalServerError)
+		return
+	}
+
+	// Clients polling with If-None-Match get an empty answer until the
+	// programmes or what is playing change.
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
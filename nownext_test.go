@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNowNextEtag(t *testing.T) {
+	start := time.Date(2026, 10, 19, 19, 0, 0, 0, time.UTC)
+	epg := EPG{Title: "Dagsrevyen", Channel: "NRK1", StartTime: start, StopTime: start.Add(45 * time.Minute)}
+	nowNext := func(at time.Duration, playing bool) NowNext {
+		p := getNowNextProgramme(epg, start.Add(at), time.UTC)
+		return NowNext{Channels: []NowNextChannel{{Channel: "NRK1", Playing: playing, Now: p}}}
+	}
+
+	first := nowNext(5*time.Minute, false)
+	tag, err := getNowNextEtag(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Channels[0].Now.Percent != 11 {
+		t.Errorf("Percent = %d, want 11, and unchanged by the ETag", first.Channels[0].Now.Percent)
+	}
+	if later, _ := getNowNextEtag(nowNext(30*time.Minute, false)); later != tag {
+		t.Errorf("ETag changed with the percent: %s, then %s", tag, later)
+	}
+	if playing, _ := getNowNextEtag(nowNext(5*time.Minute, true)); playing == tag {
+		t.Errorf("ETag did not change with the playing channel")
+	}
+}
+
+func TestEtagMatches(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{`"abc"`, true},
+		{`W/"abc"`, true},
+		{`"def", "abc"`, true},
+		{`"def"`, false},
+		{"*", true},
+	}
+	for _, test := range tests {
+		if got := etagMatches(test.header, `"abc"`); got != test.want {
+			t.Errorf("etagMatches(%q) = %v, want %v", test.header, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Finds the address VLC should play for a channel, for addresses that can't
+// be stored as they are, e.g. tokenised streams which expire.
+type Resolver interface {
+	Resolve(address *url.URL) (string, error)
+}
+
+// The resolvers by the scheme of the addresses they resolve. Addresses with
+// other schemes are played as they are.
+var resolvers = make(map[string]Resolver)
+
+// Times to try resolving an address, and how long to wait the first time.
+const defaultResolverRetries = 3
+const resolverRetryWait = 2 * time.Second
+
+// Resolving is done as streams and recordings start, so the sites may not take long.
+var resolverClient = &http.Client{Timeout: 10 * time.Second}
+
+func registerResolver(scheme string, r Resolver) {
+	resolvers[scheme] = r
+}
+
+func init() {
+	registerResolver("hls+master", hlsMasterResolver{Scheme: "https"})
+	registerResolver("hls+master+http", hlsMasterResolver{Scheme: "http"})
+}
+
+func resolveAddress(address string) (string, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return address, nil
+	}
+	resolver, ok := resolvers[u.Scheme]
+	if !ok {
+		return address, nil
+	}
+
+	// The sites may be slow or down for a moment, so try again, waiting longer each time.
+	retries := config.ResolverRetries
+	if retries <= 0 {
+		retries = defaultResolverRetries
+	}
+	wait := resolverRetryWait
+	for i := 1; ; i++ {
+		resolved, err := resolver.Resolve(u)
+		if err == nil {
+			logMessage("info", fmt.Sprintf("Resolved '%s' to '%s'", address, resolved), nil)
+			return resolved, nil
+		}
+		if i >= retries {
+			return "", fmt.Errorf("Could not resolve '%s': %v", address, err)
+		}
+		logMessage("warn", fmt.Sprintf("Could not resolve '%s', trying again", address), err)
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// Picks a variant from a HLS master playlist, e.g. for
+// hls+master://example.com/master.m3u8?bandwidth=3528000 the one with the
+// highest bandwidth not above 3528000. Without a bandwidth, the best is chosen.
+type hlsMasterResolver struct {
+	Scheme string
+}
+
+// Matches the bandwidth of a variant, and not the average bandwidth.
+var hlsBandwidth = regexp.MustCompile(`[:,]BANDWIDTH=(\d+)`)
+
+type hlsVariant struct {
+	Bandwidth int
+	Address   string
+}
+
+func (h hlsMasterResolver) Resolve(address *url.URL) (string, error) {
+	// The bandwidth is ours, the rest of the query belongs to the site and is kept as it is.
+	master := *address
+	master.Scheme = h.Scheme
+	wanted, _ := strconv.Atoi(address.Query().Get("bandwidth"))
+	var params []string
+	for _, param := range strings.Split(address.RawQuery, "&") {
+		if param != "" && !strings.HasPrefix(param, "bandwidth=") {
+			params = append(params, param)
+		}
+	}
+	master.RawQuery = strings.Join(params, "&")
+
+	resp, err := resolverClient.Get(master.String())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Got status '%s' fetching %s", resp.Status, master.String())
+	}
+
+	variants, err := parseHlsMaster(resp.Body, resp.Request.URL)
+	if err != nil {
+		return "", err
+	}
+	variant, ok := pickHlsVariant(variants, wanted)
+	if !ok {
+		return "", fmt.Errorf("No variants in %s", master.String())
+	}
+	return variant.Address, nil
+}
+
+func parseHlsMaster(r io.Reader, base *url.URL) ([]hlsVariant, error) {
+	var variants []hlsVariant
+	var current *hlsVariant
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
+			v := hlsVariant{}
+			if m := hlsBandwidth.FindStringSubmatch(line); m != nil {
+				v.Bandwidth, _ = strconv.Atoi(m[1])
+			}
+			current = &v
+		case line == "" || strings.HasPrefix(line, "#"):
+		case current != nil:
+			// The address of the variant may be relative to the master.
+			u, err := base.Parse(line)
+			if err != nil {
+				return variants, err
+			}
+			// Given to VLC, so only streams over the web, and not e.g. local files.
+			if u.Scheme != "http" && u.Scheme != "https" {
+				current = nil
+				continue
+			}
+			current.Address = u.String()
+			variants = append(variants, *current)
+			current = nil
+		}
+	}
+	return variants, scanner.Err()
+}
+
+func pickHlsVariant(variants []hlsVariant, wanted int) (hlsVariant, bool) {
+	// The best not above what is wanted, or else the lowest there is.
+	var best, lowest *hlsVariant
+	for i, v := range variants {
+		if lowest == nil || v.Bandwidth < lowest.Bandwidth {
+			lowest = &variants[i]
+		}
+		if (wanted <= 0 || v.Bandwidth <= wanted) && (best == nil || v.Bandwidth > best.Bandwidth) {
+			best = &variants[i]
+		}
+	}
+	if best != nil {
+		return *best, true
+	}
+	if lowest != nil {
+		return *lowest, true
+	}
+	return hlsVariant{}, false
+}
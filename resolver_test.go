@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseHlsMaster(t *testing.T) {
+	master := `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360
+low/index.m3u8
+#EXT-X-STREAM-INF:AVERAGE-BANDWIDTH=2000000,BANDWIDTH=2500000,CODECS="avc1.64001f,mp4a.40.2"
+/hd/index.m3u8?token=abc
+
+#EXT-X-STREAM-INF:BANDWIDTH=5000000
+https://cdn.example.com/full/index.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=100000
+file:///etc/passwd
+http://example.com/without-stream-inf.m3u8
+`
+	base, _ := url.Parse("https://example.com/live/master.m3u8")
+	variants, err := parseHlsMaster(strings.NewReader(master), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []hlsVariant{
+		{Bandwidth: 800000, Address: "https://example.com/live/low/index.m3u8"},
+		{Bandwidth: 2500000, Address: "https://example.com/hd/index.m3u8?token=abc"},
+		{Bandwidth: 5000000, Address: "https://cdn.example.com/full/index.m3u8"},
+	}
+	if !reflect.DeepEqual(variants, want) {
+		t.Errorf("parseHlsMaster = %+v, want %+v", variants, want)
+	}
+}
+
+func TestPickHlsVariant(t *testing.T) {
+	variants := []hlsVariant{
+		{Bandwidth: 2500000, Address: "hd"},
+		{Bandwidth: 800000, Address: "low"},
+		{Bandwidth: 5000000, Address: "full"},
+	}
+	tests := []struct {
+		wanted int
+		want   string
+	}{
+		{0, "full"},
+		{3000000, "hd"},
+		{2500000, "hd"},
+		{1000000, "low"},
+		// Below all of them, the lowest there is.
+		{100000, "low"},
+	}
+	for _, test := range tests {
+		got, ok := pickHlsVariant(variants, test.wanted)
+		if !ok || got.Address != test.want {
+			t.Errorf("pickHlsVariant(%d) = %q, %v, want %q", test.wanted, got.Address, ok, test.want)
+		}
+	}
+	if _, ok := pickHlsVariant(nil, 0); ok {
+		t.Errorf("pickHlsVariant of no variants should find none")
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type SubscriptionRun struct {
+	Reason     string
+	Started    string
+	Duration   string
+	Recordings int
+	Error      string
+}
+
+type SchedulerStatus struct {
+	LastRun       time.Time
+	LastError     string
+	LastErrorTime time.Time
+	NextRun       time.Time
+	// How long the last check took, and the checks since the server started.
+	LastDuration time.Duration
+	Runs         int
+}
+
+// Default minutes between each subscription check, if not set in the config.
+const defaultSubscriptionInterval = 15
+
+var subscriptionTrigger = make(chan string, 1)
+var schedulerStatus SchedulerStatus
+var schedulerLock sync.Mutex
+
+func getSubscriptionInterval() time.Duration {
+	if config.SubscriptionInterval <= 0 {
+		return defaultSubscriptionInterval * time.Minute
+	}
+	return time.Duration(config.SubscriptionInterval) * time.Minute
+}
+
+func triggerSubscriptionCheck(reason string) {
+	// Ask the scheduler for a check, unless one is already waiting.
+	select {
+	case subscriptionTrigger <- reason:
+	default:
+	}
+}
+
+func getEpgFingerprint() (string, error) {
+	// We'll use the DB, so ensure it is up.
+	ensureDbhConnection()
+
+	// Changes whenever programmes are added to or removed from the EPG.
+	var count int64
+	var last string
+	err := dbh.QueryRow("SELECT count(*), coalesce(max(stop)::text, '') FROM epg").Scan(&count, &last)
+	return fmt.Sprintf("%d/%s", count, last), err
+}
+
+func runSubscriptionCheck(reason string) {
+	started := time.Now()
+	count, err := checkSubscriptions()
+	finished := time.Now()
+
+	errstr := ""
+	if err != nil {
+		logMessage("warn", "Could not check and refresh the subscriptions", err)
+		errstr = err.Error()
+	}
+
+	schedulerLock.Lock()
+	schedulerStatus.LastRun = finished
+	schedulerStatus.NextRun = finished.Add(getSubscriptionInterval())
+	schedulerStatus.LastDuration = finished.Sub(started)
+	schedulerStatus.Runs += 1
+	if err != nil {
+		schedulerStatus.LastError = errstr
+		schedulerStatus.LastErrorTime = finished
+	}
+	schedulerLock.Unlock()
+
+	// Keep a log of the runs in the DB as well, so it survives restarts.
+	_, err = dbh.Exec(`INSERT INTO subscription_runs(reason, started, finished, recordings, error)
+                     VALUES ($1, $2, $3, $4, $5)`, reason, started, finished, count, errstr)
+	if err != nil {
+		logMessage("warn", "Could not save the subscription run", err)
+	}
+}
+
+func subscriptionScheduler() {
+	// Check right away, as the server has just started.
+	runSubscriptionCheck("oppstart")
+	fingerprint, err := getEpgFingerprint()
+	if err != nil {
+		logMessage("warn", "Could not get EPG fingerprint", err)
+	}
+
+	// Wake up every minute to see whether the EPG has changed or it's time for a check.
+	ticker := time.NewTicker(time.Minute)
+	for {
+		select {
+		case reason := <-subscriptionTrigger:
+			runSubscriptionCheck(reason)
+		case <-ticker.C:
+			current, err := getEpgFingerprint()
+			if err != nil {
+				logMessage("warn", "Could not get EPG fingerprint", err)
+			}
+
+			schedulerLock.Lock()
+			due := time.Now().After(schedulerStatus.NextRun)
+			schedulerLock.Unlock()
+
+			if err == nil && current != fingerprint {
+				// New EPG-data has been imported.
+				fingerprint = current
+				refreshEpgCache()
+				runSubscriptionCheck("EPG-import")
+			} else if due {
+				runSubscriptionCheck("intervall")
+			}
+		}
+	}
+}
+
+func getSchedulerStatus() SchedulerStatus {
+	schedulerLock.Lock()
+	defer schedulerLock.Unlock()
+	return schedulerStatus
+}
+
+func getSubscriptionRuns(limit int) ([]SubscriptionRun, error) {
+	// We'll use the DB, so ensure it is up.
+	ensureDbhConnection()
+
+	rows, err := dbh.Query(`SELECT reason, started, finished, recordings, error
+                          FROM subscription_runs
+                          ORDER BY started DESC
+                          LIMIT $1`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []SubscriptionRun
+	for rows.Next() {
+		var reason, errstr string
+		var started, finished time.Time
+		var count int
+		err := rows.Scan(&reason, &started, &finished, &count, &errstr)
+		if err != nil {
+			return runs, err
+		}
+		runs = append(runs, SubscriptionRun{
+			Reason:     reason,
+			Started:    started.In(getLocation()).Format("2006-01-02 15:04:05"),
+			Duration:   finished.Sub(started).String(),
+			Recordings: count,
+			Error:      errstr,
+		})
+	}
+	return runs, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	auth "github.com/abbot/go-http-auth"
+	"github.com/lib/pq"
+	"net/http"
+	"time"
+)
+
+type SearchQuery struct {
+	Text     string
+	Channel  string
+	Category string
+	From     time.Time
+	To       time.Time
+}
+
+// The document searched for each programme. It must be the same as in the
+// epg_search index in contrib/db.sql, for the index to be used.
+const epgSearchVector = `(setweight(to_tsvector('norwegian', coalesce(epg.title, '')), 'A') ||
+                          setweight(to_tsvector('norwegian', coalesce(epg.sub_title, '')), 'B') ||
+                          setweight(to_tsvector('norwegian', coalesce(epg.description, '')), 'C'))`
+
+// Maximum number of hits returned from a search.
+const maxSearchHits = 200
+
+func searchEpg(q SearchQuery) ([]EPG, error) {
+	// We'll use the DB, so ensure it is up.
+	ensureDbhConnection()
+
+	// Best hits first, and then by time. Without text we just list what is on.
+	rows, err := dbh.Query(`SELECT `+epgColumns+`
+                          FROM epg
+                          WHERE ($1 = '' OR `+epgSearchVector+` @@ plainto_tsquery('norwegian', $1))
+                          AND ($2 = '' OR epg.channel = $2)
+                          AND epg.categories @> $3
+                          AND epg.stop > $4
+                          AND epg.start < $5
+                          ORDER BY ts_rank(`+epgSearchVector+`, plainto_tsquery('norwegian', $1)) DESC, epg.start
+                          LIMIT $6`,
+		q.Text, q.Channel, pq.Array(splitCategory(q.Category)), q.From, q.To, maxSearchHits)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hits []EPG
+	for rows.Next() {
+		epg, err := scanEPG(rows)
+		if err != nil {
+			return hits, err
+		}
+		hits = append(hits, epg)
+	}
+	return hits, rows.Err()
+}
+
+func getSearchQuery(r *auth.AuthenticatedRequest, loc *time.Location) SearchQuery {
+	// Dates are whole days where the user is, and default to everything from now on.
+	layout := "2006-01-02"
+	q := SearchQuery{
+		Text:     r.FormValue("q"),
+		Channel:  r.FormValue("channel"),
+		Category: r.FormValue("category"),
+		From:     time.Now(),
+		To:       time.Now().AddDate(1, 0, 0),
+	}
+	if from, err := time.ParseInLocation(layout, r.FormValue("from"), loc); err == nil {
+		q.From = from
+	}
+	if to, err := time.ParseInLocation(layout, r.FormValue("to"), loc); err == nil {
+		q.To = to.AddDate(0, 0, 1)
+	}
+	return q
+}
+
+func searchPageHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	loc := getUserLocation(r.Username)
+	q := getSearchQuery(r, loc)
+
+	var hits []EPG
+	var err error
+	searched := q.Text != "" || q.Channel != "" || q.Category != ""
+	if searched {
+		hits, err = searchEpg(q)
+		if err != nil {
+			logMessage("warn", "Could not search the EPG", err)
+		}
+		for i := range hits {
+			hits[i] = hits[i].In(loc)
+		}
+	}
+
+	// Scripts can get the hits as JSON.
+	if r.FormValue("format") == "json" {
+		if err != nil {
+			http.Error(w, "Kunne ikke søke i EPG-data", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(hits)
+		return
+	}
+
+	categories, err := getAllCategories()
+	if err != nil {
+		logMessage("warn", "Could not get categories from DB", err)
+	}
+
+	d := make(map[string]interface{})
+	d["BaseUrl"] = config.BaseUrl
+	d["Title"] = "Søk"
+	d["User"] = r.Username
+	d["Admin"] = isAdmin(r.Username)
+	d["Channels"] = getChannels()
+	d["Categories"] = categories
+	d["Query"] = q.Text
+	d["Channel"] = q.Channel
+	d["Category"] = q.Category
+	d["From"] = r.FormValue("from")
+	d["To"] = r.FormValue("to")
+	d["Searched"] = searched
+	d["Hits"] = hits
+	w.Write(getPage("search.html", d))
+}
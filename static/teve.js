@@ -0,0 +1,247 @@
+// The pages change things through the JSON API, at /api/v1/.
+var base = function() {
+  return document.body.getAttribute("data-base");
+};
+
+var reload = function() {
+  window.location.reload();
+};
+
+var home = function() {
+  window.location = base();
+};
+
+// Calls the API, and then next with the answer, or reloads the page. Errors
+// are shown to the user. Returns false, so links and forms can return it.
+var api = function(method, path, body, next) {
+  var xhr = new XMLHttpRequest();
+  xhr.open(method, base() + "api/v1/" + path);
+  xhr.setRequestHeader("Content-Type", "application/json");
+  xhr.onload = function() {
+    var data = null;
+    try {
+      data = JSON.parse(xhr.responseText);
+    } catch (e) {}
+    if (xhr.status >= 400) {
+      alert(data && data.Error ? data.Error : "Noe gikk galt (" + xhr.status + ")");
+      return;
+    }
+    (next || reload)(data);
+  };
+  xhr.onerror = function() {
+    alert("Fikk ikke kontakt med teve");
+  };
+  xhr.send(body === undefined || body === null ? null : JSON.stringify(body));
+  return false;
+};
+
+// Sends the named fields of a form to the API. Checkboxes are sent as
+// booleans, and fields with data-type="number" as numbers.
+var apiForm = function(form, method, path, next) {
+  var body = {};
+  for (var i = 0; i < form.elements.length; i++) {
+    var e = form.elements[i];
+    if (!e.name) {
+      continue;
+    }
+    if (e.type == "checkbox") {
+      body[e.name] = e.checked;
+    } else if (e.getAttribute("data-type") == "number") {
+      body[e.name] = parseInt(e.value, 10) || 0;
+    } else {
+      body[e.name] = e.value;
+    }
+  }
+  return api(method, path, body, next);
+};
+
+// Moves a favourite up or down on the settings page, and sends the new order.
+var moveFavourite = function(id, step) {
+  var rows = document.querySelectorAll("[data-favourite]");
+  var ids = [];
+  for (var i = 0; i < rows.length; i++) {
+    ids.push(parseInt(rows[i].getAttribute("data-favourite"), 10));
+  }
+  var from = ids.indexOf(id);
+  var to = from + step;
+  if (from < 0 || to < 0 || to >= ids.length) {
+    return false;
+  }
+  ids[from] = ids[to];
+  ids[to] = id;
+  return api("PUT", "favourites", ids);
+};
+
+// Listens for the state of the page from the server, with the same query as
+// the page, and calls onState with it each time it changes. The browser
+// connects again by itself if the connection is lost.
+var live = function(onState) {
+  if (!window.EventSource) {
+    return;
+  }
+  var source = new EventSource(base() + "live" + window.location.search);
+  source.addEventListener("state", function(e) {
+    onState(JSON.parse(e.data));
+  });
+};
+
+var element = function(tag, text, attrs) {
+  var e = document.createElement(tag);
+  if (text) {
+    e.textContent = text;
+  }
+  for (var name in attrs || {}) {
+    e.setAttribute(name, attrs[name]);
+  }
+  return e;
+};
+
+var show = function(e, visible) {
+  e.style.display = visible ? "" : "none";
+};
+
+var showPlaying = function(state) {
+  var playing = document.querySelectorAll(".playing");
+  for (var i = 0; i < playing.length; i++) {
+    show(playing[i], state.Playing !== "");
+  }
+  document.getElementById("playing-channel").textContent = state.Playing;
+  document.getElementById("viewers").textContent = state.Viewers;
+  var parts = document.title.split(" :: ");
+  parts[0] = state.Playing || "-";
+  document.title = parts.join(" :: ");
+
+  // Only what the user is not changing.
+  show(document.getElementById("running"), state.Playing !== "");
+  document.getElementById("running-channel").value = state.Playing;
+  var transcoding = document.getElementById("transcoding");
+  if (transcoding !== document.activeElement) {
+    transcoding.value = state.Transcoding;
+  }
+};
+
+var showRecordings = function(state) {
+  var div = document.getElementById("recordings");
+  var list = div.querySelector("ul");
+  var recordings = state.Recordings || [];
+  show(div, recordings.length > 0);
+  list.innerHTML = "";
+  recordings.forEach(function(r) {
+    var li = element("li");
+    li.appendChild(element("b", r.Start + "=>" + r.Stop));
+    li.appendChild(document.createTextNode(": "));
+    li.appendChild(element("em", r.Title));
+    var text = (r.EpisodeNum ? " (" + r.EpisodeNum + ")" : "") + (r.SubTitle ? ": " + r.SubTitle : "");
+    text += " på " + r.Channel + " av " + r.User + " med transkoding: " + r.Transcoding;
+    if (r.Running) {
+      text += " – tar opp, " + r.Percent + " %";
+    }
+    li.appendChild(document.createTextNode(text + " ("));
+    var stop = element("a", "Stopp/slett", {href: "#"});
+    stop.onclick = function() {
+      return api("DELETE", "recordings/" + r.Id);
+    };
+    li.appendChild(stop);
+    li.appendChild(document.createTextNode(")"));
+    list.appendChild(li);
+  });
+};
+
+// The two rows of a programme, as on the page.
+var programmeRows = function(channel, p, transcoding) {
+  var row = element("tr", null, {"class": "programme", "data-start": Date.parse(p.StartTime) / 1000});
+  var record = element("a", "◉", {href: "#", title: "Start opptak av dette programmet", "class": "record-button"});
+  record.onclick = function() {
+    return api("POST", "recordings", {Channel: channel, Title: p.Title, Start: p.StartTime, Stop: p.StopTime, Transcoding: transcoding});
+  };
+  var cell = element("td", null, {"class": "prop"});
+  cell.appendChild(record);
+  row.appendChild(cell);
+  row.appendChild(element("td", p.Start, {"class": "prop"}));
+  row.appendChild(element("td", p.Stop, {"class": "prop"}));
+  cell = element("td");
+  var title = element("a", p.Title, {href: "#", title: "Se detaljer", "class": "clean-link"});
+  title.onclick = function() {
+    toggle(this);
+    return false;
+  };
+  cell.appendChild(title);
+  if (p.Episode) {
+    cell.appendChild(document.createTextNode(" "));
+    cell.appendChild(element("small", p.Episode));
+  }
+  row.appendChild(cell);
+
+  var description = element("tr", null, {"class": "description", style: "display:none"});
+  for (var i = 0; i < 3; i++) {
+    description.appendChild(element("td", null, {"class": "prop"}));
+  }
+  cell = element("td");
+  if (p.Icon) {
+    cell.appendChild(element("img", null, {src: p.Icon, "class": "poster", alt: ""}));
+  }
+  if (p.SubTitle) {
+    cell.appendChild(element("b", p.SubTitle));
+    cell.appendChild(element("br"));
+  }
+  cell.appendChild(element("em", p.Description));
+  if (p.Categories && p.Categories.length) {
+    cell.appendChild(element("br"));
+    cell.appendChild(document.createTextNode("Kategori: " + p.Categories.join(", ")));
+  }
+  if (p.Rating) {
+    cell.appendChild(element("br"));
+    cell.appendChild(document.createTextNode("Aldersgrense: " + p.Rating));
+  }
+  (p.Credits || []).forEach(function(c) {
+    cell.appendChild(element("br"));
+    cell.appendChild(document.createTextNode(c.Role + ": " + c.Names));
+  });
+  description.appendChild(cell);
+  return [row, description];
+};
+
+// Removes the programmes which have ended and adds those which are new, so
+// open descriptions stay open.
+var showProgrammes = function(state) {
+  var tables = document.querySelectorAll("table[data-channel]");
+  for (var i = 0; i < tables.length; i++) {
+    var table = tables[i];
+    var channel = table.getAttribute("data-channel");
+    var programmes = state.Channels[channel] || [];
+    var body = table.tBodies[0] || table.appendChild(element("tbody"));
+    var starts = {};
+    programmes.forEach(function(p) {
+      starts[Date.parse(p.StartTime) / 1000] = true;
+    });
+    var shown = {};
+    var rows = body.querySelectorAll("tr.programme");
+    for (var j = 0; j < rows.length; j++) {
+      var start = rows[j].getAttribute("data-start");
+      if (starts[start]) {
+        shown[start] = true;
+      } else {
+        body.removeChild(rows[j].nextElementSibling);
+        body.removeChild(rows[j]);
+      }
+    }
+    programmes.forEach(function(p) {
+      if (!shown[Date.parse(p.StartTime) / 1000]) {
+        programmeRows(channel, p, state.Transcoding).forEach(function(row) {
+          body.appendChild(row);
+        });
+      }
+    });
+    rows = body.querySelectorAll("tr.programme");
+    for (j = 0; j < rows.length; j++) {
+      rows[j].className = (j ? "" : "header ") + "programme";
+    }
+    show(table.previousElementSibling, programmes.length == 0);
+  }
+};
+
+var showLiveState = function(state) {
+  showPlaying(state);
+  showRecordings(state);
+  showProgrammes(state);
+};
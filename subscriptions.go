@@ -0,0 +1,593 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	auth "github.com/abbot/go-http-auth"
+	"github.com/lib/pq"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Follower struct {
+	Username string
+	NewOnly  bool
+	Notify   bool
+	KeepDays int
+}
+
+// A new subscription, as given to the API and the preview page.
+type SubscriptionRequest struct {
+	Title    string
+	Channel  string
+	Category string
+	Weekday  int
+	Hour     int
+	NewOnly  bool
+	Notify   bool
+	KeepDays int
+}
+
+type SubscriptionMatch struct {
+	Subscription int64
+	Title        string
+	Channel      string
+	Start        string
+	Stop         string
+	Description  string
+	Episode      string
+	Username     string
+	NewOnly      bool
+	// Already in the planned recordings.
+	Scheduled bool
+	// The episode has been recorded, or is planned, earlier.
+	Recorded bool
+	// Will be recorded when the subscriptions are checked.
+	Record    bool
+	Conflicts []string
+	StartTime time.Time
+	StopTime  time.Time
+}
+
+func subscriptionWindow(intervalStart, intervalStop int) (hour, size int) {
+	// The interval is stored as hours around the chosen start hour, and may wrap
+	// around midnight, e.g. 22 to 2 for a subscription around midnight.
+	size = ((intervalStop - intervalStart + 24) % 24) / 2
+	return addHoursToInt(intervalStart, size), size
+}
+
+func subscriptionCoversTime(s Subscription, t time.Time) bool {
+	// Minutes from the chosen start hour to the programme, between -12 and 12 hours,
+	// on the clock of the server so it follows the changes to and from summer time.
+	t = t.In(getLocation())
+	minutes := t.Hour()*60 + t.Minute() - s.Hour*60
+	if minutes > 12*60 {
+		minutes -= 24 * 60
+	} else if minutes <= -12*60 {
+		minutes += 24 * 60
+	}
+	if minutes < -s.Size*60 || minutes > s.Size*60 {
+		return false
+	}
+
+	// The weekday is the one of the chosen hour, so a programme just after
+	// midnight belongs to a subscription on the day before.
+	anchor := t.Add(-time.Duration(minutes) * time.Minute)
+	return int(anchor.Weekday()) == s.Day
+}
+
+func querySubscriptions(where string, args ...interface{}) ([]Subscription, error) {
+	// We'll use the DB, so ensure it is up.
+	ensureDbhConnection()
+
+	// Only record new episodes if every follower wants that.
+	rows, err := dbh.Query(`SELECT s.id, s.title, s.interval_start, s.interval_stop, s.weekday, s.channel, s.username,
+                          coalesce(s.category, ''), coalesce(bool_and(f.new_only), false), count(f.username)
+                          FROM subscriptions s
+                          LEFT JOIN subscription_followers f ON f.subscription_id = s.id
+                          `+where+`
+                          GROUP BY s.id
+                          HAVING count(f.username) > 0
+                          ORDER BY s.id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []Subscription
+	for rows.Next() {
+		var title, channel, username, category string
+		var id, interval_start, interval_stop, weekday, followers int
+		var newOnly bool
+		err := rows.Scan(&id, &title, &interval_start, &interval_stop, &weekday, &channel, &username, &category, &newOnly, &followers)
+		if err != nil {
+			return subs, err
+		}
+		hour, size := subscriptionWindow(interval_start, interval_stop)
+		sub := newSubscription(int64(id), title, channel, category, username, weekday, hour, size, newOnly)
+		sub.Followers = followers
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+func newSubscription(id int64, title, channel, category, username string, weekday, hour, size int, newOnly bool) Subscription {
+	// Gives more sense that something happens at 00, compared to 24.
+	stime := zeroPad(strconv.Itoa(hour % 24))
+
+	return Subscription{
+		Id:        id,
+		Title:     title,
+		StartTime: stime,
+		Weekday:   getNorwegianWeekday(weekday),
+		Channel:   channel,
+		Category:  category,
+		NewOnly:   newOnly,
+		Username:  username,
+		Day:       weekday,
+		Hour:      hour,
+		Size:      size,
+	}
+}
+
+func getSubscriptionMatches(s Subscription) ([]SubscriptionMatch, error) {
+	// We'll use the DB, so ensure it is up.
+	ensureDbhConnection()
+
+	// Get all upcoming airings of this title, or every title in the category, on
+	// the channel, and filter on time afterwards.
+	rows, err := dbh.Query(`SELECT epg.title, epg.start, epg.stop, coalesce(epg.description, ''),
+                          coalesce(epg.episode_num, ''), coalesce(epg.sub_title, ''),
+                          EXISTS (SELECT 1 FROM recordings
+                                  WHERE recordings.title = epg.title
+                                  AND recordings.channel = epg.channel
+                                  AND recordings.start = epg.start)
+                          FROM epg
+                          WHERE ($1 = '' OR epg.title = $1)
+                          AND epg.channel = $2
+                          AND epg.categories @> $3
+                          AND epg.stop > now()
+                          ORDER BY epg.start`, s.Title, s.Channel, pq.Array(splitCategory(s.Category)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	layout := "2006-01-02 15:04"
+	var matches []SubscriptionMatch
+	for rows.Next() {
+		var title, description, episodeNum, subTitle string
+		var start, stop time.Time
+		var scheduled bool
+		err := rows.Scan(&title, &start, &stop, &description, &episodeNum, &subTitle, &scheduled)
+		if err != nil {
+			return matches, err
+		}
+		if !subscriptionCoversTime(s, start) {
+			continue
+		}
+		start, stop = start.In(getLocation()), stop.In(getLocation())
+		matches = append(matches, SubscriptionMatch{
+			Subscription: s.Id,
+			Title:        title,
+			Channel:      s.Channel,
+			Start:        start.Format(layout),
+			Stop:         stop.Format(layout),
+			Description:  description,
+			Episode:      episodeKey(episodeNum, subTitle, description),
+			Username:     s.Username,
+			NewOnly:      s.NewOnly,
+			Scheduled:    scheduled,
+			StartTime:    start,
+			StopTime:     stop,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return matches, err
+	}
+
+	// Check whether we have the episodes already, which only matters for new-only
+	// subscriptions. Unknown episodes are never considered recorded.
+	var titles []string
+	seen := make(map[string]bool)
+	for _, m := range matches {
+		if m.Episode != "" && !seen[m.Title] {
+			seen[m.Title] = true
+			titles = append(titles, m.Title)
+		}
+	}
+	recorded, err := getRecordedEpisodes(titles)
+	if err != nil {
+		return matches, err
+	}
+	for i := range matches {
+		matches[i].Recorded = matches[i].Episode != "" && recorded[episodeId(matches[i].Title, matches[i].Episode)]
+	}
+	return matches, nil
+}
+
+func selectRecordings(matches []SubscriptionMatch) {
+	// Go through the matches in the order they air, so that the first airing of
+	// an episode is recorded and later reruns skipped.
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].StartTime.Before(matches[j].StartTime)
+	})
+
+	// An airing may match several subscriptions, e.g. one for the title and
+	// one for the category, but is only recorded once.
+	picked := make(map[string]bool)
+	airings := make(map[string]bool)
+	for i := range matches {
+		m := &matches[i]
+		id := episodeId(m.Title, m.Episode)
+		airing := m.Channel + "\x00" + m.StartTime.UTC().Format(time.RFC3339)
+		switch {
+		case m.Scheduled:
+			// Already planned, nothing more to do.
+		case airings[airing]:
+			// Recorded for another subscription.
+		case m.NewOnly && m.Episode != "" && (m.Recorded || picked[id]):
+			// We have this episode already.
+		default:
+			m.Record = true
+		}
+		if m.Episode != "" && (m.Scheduled || m.Record) {
+			picked[id] = true
+		}
+		if m.Scheduled || m.Record {
+			airings[airing] = true
+		}
+	}
+}
+
+func getNextAiring(s Subscription, loc *time.Location) (string, error) {
+	matches, err := getSubscriptionMatches(s)
+	if err != nil {
+		return "", err
+	}
+	selectRecordings(matches)
+	for _, m := range matches {
+		if m.Scheduled || m.Record {
+			return m.In(loc).Start, nil
+		}
+	}
+	return "", nil
+}
+
+func getMatchConflicts(m SubscriptionMatch, loc *time.Location) ([]string, error) {
+	// We'll use the DB, so ensure it is up.
+	ensureDbhConnection()
+
+	// Other planned recordings running at the same time.
+	rows, err := dbh.Query(`SELECT title, channel, start, stop FROM recordings
+                          WHERE start < $1
+                          AND stop > $2
+                          AND NOT (title = $3 AND channel = $4 AND start = $2)
+                          ORDER BY start`, m.StopTime, m.StartTime, m.Title, m.Channel)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var conflicts []string
+	for rows.Next() {
+		var title, channel string
+		var start, stop time.Time
+		err := rows.Scan(&title, &channel, &start, &stop)
+		if err != nil {
+			return conflicts, err
+		}
+		conflicts = append(conflicts, fmt.Sprintf("Overlapper med opptak av %s på %s (%s-%s)",
+			title, channel, start.In(loc).Format("15:04"), stop.In(loc).Format("15:04")))
+	}
+	return conflicts, rows.Err()
+}
+
+func getExistingSubscription(s Subscription) (*Subscription, error) {
+	// A new subscription on the same program joins the one already there.
+	if s.Id != 0 {
+		return nil, nil
+	}
+	existing, err := querySubscriptions("WHERE s.title = $1 AND s.weekday = $2 AND s.channel = $3 AND s.category = $4",
+		s.Title, s.Day, s.Channel, s.Category)
+	if err != nil || len(existing) == 0 {
+		return nil, err
+	}
+	return &existing[0], nil
+}
+
+func getFollower(id int64, username string) (Follower, error) {
+	// We'll use the DB, so ensure it is up.
+	ensureDbhConnection()
+
+	f := Follower{Username: username}
+	err := dbh.QueryRow(`SELECT new_only, notify, keep_days FROM subscription_followers
+                       WHERE subscription_id = $1 AND username = $2`, id, username).Scan(&f.NewOnly, &f.Notify, &f.KeepDays)
+	return f, err
+}
+
+// Returned when the subscription exists, followed by others at another hour.
+type subscriptionTimeError struct {
+	Hour int
+}
+
+func (e subscriptionTimeError) Error() string {
+	return fmt.Sprintf("Abonnementet finnes allerede kl. %s. Velg det tidspunktet for å følge det.", zeroPad(strconv.Itoa(e.Hour%24)))
+}
+
+func followSubscription(title string, weekday int, interval []int, channel, category string, f Follower) error {
+	// We'll use the DB, so ensure it is up.
+	ensureDbhConnection()
+
+	tx, err := dbh.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Use the existing rule for this program, or create it.
+	var id int64
+	var start, stop int
+	err = tx.QueryRow(`SELECT id, interval_start, interval_stop FROM subscriptions
+                     WHERE title = $1 AND weekday = $2 AND channel = $3 AND category = $4`,
+		title, weekday, channel, category).Scan(&id, &start, &stop)
+	if err == nil && (start != interval[0] || stop != interval[1]) {
+		// The rule is shared, so another time would change it for the others.
+		hour, _ := subscriptionWindow(start, stop)
+		return subscriptionTimeError{hour}
+	}
+	if err == sql.ErrNoRows {
+		err = tx.QueryRow(`INSERT INTO subscriptions(
+                       title,interval_start,interval_stop,weekday,channel,username,category) VALUES
+                       ($1,$2,$3,$4,$5,$6,$7) RETURNING id`,
+			title, interval[0], interval[1], weekday, channel, f.Username, category).Scan(&id)
+	}
+	if err != nil {
+		return err
+	}
+
+	// And add the user as a follower, or update the preferences if already following.
+	_, err = tx.Exec(`INSERT INTO subscription_followers(subscription_id, username, new_only, notify, keep_days)
+                    VALUES ($1, $2, $3, $4, $5)
+                    ON CONFLICT (subscription_id, username) DO UPDATE
+                    SET new_only = EXCLUDED.new_only, notify = EXCLUDED.notify, keep_days = EXCLUDED.keep_days`,
+		id, f.Username, f.NewOnly, f.Notify, f.KeepDays)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (req SubscriptionRequest) Subscription(username string) (Subscription, error) {
+	category := strings.Join(splitCategory(req.Category), "/")
+	if req.Title == "" && category == "" {
+		return Subscription{}, errors.New("Abonnementet må ha en tittel eller kategori")
+	}
+	if _, err := getChannel(req.Channel, ""); err != nil {
+		return Subscription{}, errors.New("Ukjent kanal")
+	}
+	if req.Weekday < 0 || req.Weekday > 6 || req.Hour < 0 || req.Hour > 23 {
+		return Subscription{}, errors.New("Ugyldig dag eller tidspunkt")
+	}
+	if req.KeepDays < 0 {
+		req.KeepDays = 0
+	}
+	sub := newSubscription(0, req.Title, req.Channel, category, username, req.Weekday, req.Hour, config.SubIntervalSize, req.NewOnly)
+	sub.Follower = Follower{Username: username, NewOnly: req.NewOnly, Notify: req.Notify, KeepDays: req.KeepDays}
+	return sub, nil
+}
+
+func startSubscription(sub Subscription) (Subscription, error) {
+	// Insert the subscription, or follow it if someone else already subscribes to it.
+	interval := []int{addHoursToInt(sub.Hour, -sub.Size), addHoursToInt(sub.Hour, sub.Size)}
+	err := followSubscription(sub.Title, sub.Day, interval, sub.Channel, sub.Category, sub.Follower)
+	if err != nil {
+		return sub, err
+	}
+
+	// And check if we should start a recording right away.
+	triggerSubscriptionCheck("nytt abonnement")
+
+	existing, err := getExistingSubscription(sub)
+	if err != nil || existing == nil {
+		return sub, err
+	}
+	existing.Follower = sub.Follower
+	return *existing, nil
+}
+
+func updateFollower(id int64, f Follower) error {
+	// We'll use the DB, so ensure it is up.
+	ensureDbhConnection()
+
+	// Users can only change their own preferences.
+	if f.KeepDays < 0 {
+		f.KeepDays = 0
+	}
+	res, err := dbh.Exec(`UPDATE subscription_followers SET new_only = $1, notify = $2, keep_days = $3
+                        WHERE subscription_id = $4 AND username = $5`, f.NewOnly, f.Notify, f.KeepDays, id, f.Username)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errNotFollowing
+	}
+	return nil
+}
+
+func expireRecordings() error {
+	// We'll use the DB, so ensure it is up.
+	ensureDbhConnection()
+
+	// Recordings are kept as long as the follower keeping them the longest
+	// wants, and forever if any of them has 0 days.
+	rows, err := dbh.Query(`SELECT h.id, h.filename
+                          FROM episode_history h
+                          JOIN subscription_followers f ON f.subscription_id = h.subscription_id
+                          WHERE NOT h.expired
+                          AND h.filename <> ''
+                          GROUP BY h.id, h.filename, h.recorded
+                          HAVING bool_and(f.keep_days > 0)
+                          AND h.recorded + max(f.keep_days) * interval '1 day' < now()`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	expired := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var filename string
+		err := rows.Scan(&id, &filename)
+		if err != nil {
+			return err
+		}
+		expired[id] = filename
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, filename := range expired {
+		err := os.Remove(filename)
+		if err != nil && !os.IsNotExist(err) {
+			logMessage("warn", "Could not delete expired recording", err)
+			continue
+		}
+		_, err = dbh.Exec("UPDATE episode_history SET expired = true WHERE id = $1", id)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(expired) > 0 {
+		logMessage("info", fmt.Sprintf("Deleted %d expired recordings", len(expired)), nil)
+	}
+	return nil
+}
+
+func expireRecordingsLoop() {
+	for {
+		err := expireRecordings()
+		if err != nil {
+			logMessage("warn", "Could not delete expired recordings", err)
+		}
+
+		// Once an hour is plenty, as we count in days.
+		time.Sleep(time.Hour)
+	}
+}
+
+func getFollowedFiles(username string) (map[string]bool, error) {
+	// We'll use the DB, so ensure it is up.
+	ensureDbhConnection()
+
+	// All recordings made for subscriptions this user follows.
+	rows, err := dbh.Query(`SELECT h.filename FROM episode_history h
+                          JOIN subscription_followers f ON f.subscription_id = h.subscription_id
+                          WHERE f.username = $1
+                          AND NOT h.expired`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := make(map[string]bool)
+	for rows.Next() {
+		var filename string
+		err := rows.Scan(&filename)
+		if err != nil {
+			return files, err
+		}
+		files[filepath.Base(filename)] = true
+	}
+	return files, rows.Err()
+}
+
+func getSubscriptionFromRequest(r *auth.AuthenticatedRequest) (Subscription, error) {
+	// An existing subscription, given by id.
+	if r.FormValue("id") != "" {
+		id, err := strconv.Atoi(r.FormValue("id"))
+		if err != nil {
+			return Subscription{}, err
+		}
+		subs, err := querySubscriptions("WHERE id = $1", id)
+		if err != nil {
+			return Subscription{}, err
+		}
+		if len(subs) == 0 {
+			return Subscription{}, fmt.Errorf("Did not find subscription %d", id)
+		}
+		return subs[0], nil
+	}
+
+	// Or a proposed one, from the same form as the API is given.
+	req := SubscriptionRequest{
+		Title:    r.FormValue("Title"),
+		Channel:  r.FormValue("Channel"),
+		Category: r.FormValue("Category"),
+		NewOnly:  r.FormValue("NewOnly") != "",
+		Notify:   r.FormValue("Notify") != "",
+	}
+	var err error
+	if req.Weekday, err = strconv.Atoi(r.FormValue("Weekday")); err != nil {
+		return Subscription{}, err
+	}
+	if req.Hour, err = strconv.Atoi(r.FormValue("Hour")); err != nil {
+		return Subscription{}, err
+	}
+	return req.Subscription(r.Username)
+}
+
+func getSubscriptionPreview(sub Subscription, loc *time.Location) ([]SubscriptionMatch, *Subscription, error) {
+	// Find what would be recorded, without starting anything.
+	matches, err := getSubscriptionMatches(sub)
+	if err != nil {
+		return nil, nil, err
+	}
+	selectRecordings(matches)
+	for i := range matches {
+		if matches[i].Record {
+			matches[i].Conflicts, err = getMatchConflicts(matches[i], loc)
+			if err != nil {
+				logMessage("warn", "Could not get conflicts for subscription match", err)
+			}
+		}
+		matches[i] = matches[i].In(loc)
+	}
+	existing, err := getExistingSubscription(sub)
+	return matches, existing, err
+}
+
+func previewSubscriptionHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	sub, err := getSubscriptionFromRequest(r)
+	if err != nil {
+		logMessage("warn", "Could not parse subscription to preview", err)
+		http.Error(w, "Ugyldig abonnement", http.StatusBadRequest)
+		return
+	}
+	matches, existing, err := getSubscriptionPreview(sub, getUserLocation(r.Username))
+	if err != nil {
+		logMessage("warn", "Could not get subscription matches", err)
+		http.Error(w, "Kunne ikke hente EPG-data", http.StatusInternalServerError)
+		return
+	}
+
+	d := make(map[string]interface{})
+	d["BaseUrl"] = config.BaseUrl
+	d["Title"] = "Forhåndsvisning"
+	d["User"] = r.Username
+	d["Admin"] = isAdmin(r.Username)
+	d["Subscription"] = sub
+	d["Matches"] = matches
+	d["Existing"] = existing
+	d["From"] = zeroPad(strconv.Itoa(addHoursToInt(sub.Hour, -sub.Size)))
+	d["To"] = zeroPad(strconv.Itoa(addHoursToInt(sub.Hour, sub.Size)))
+	w.Write(getPage("preview.html", d))
+}
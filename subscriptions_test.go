@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSelectRecordings(t *testing.T) {
+	at := func(hour int) time.Time { return time.Date(2026, 10, 19, hour, 0, 0, 0, time.UTC) }
+	matches := []SubscriptionMatch{
+		// The same airing for a title and a category subscription.
+		{Subscription: 1, Title: "Dagsrevyen", Channel: "NRK1", StartTime: at(19)},
+		{Subscription: 2, Title: "Dagsrevyen", Channel: "NRK1", StartTime: at(19)},
+		// A rerun of an episode recorded earlier, for new-only and not.
+		{Subscription: 3, Title: "Lindmo", Channel: "NRK1", Episode: "s1e5", NewOnly: true, StartTime: at(22)},
+		{Subscription: 3, Title: "Lindmo", Channel: "NRK2", Episode: "s1e5", NewOnly: true, StartTime: at(23)},
+		{Subscription: 4, Title: "Lindmo", Channel: "NRK3", Episode: "s1e5", StartTime: at(23)},
+		// Planned already, which also takes the airing.
+		{Subscription: 5, Title: "Debatten", Channel: "NRK1", Scheduled: true, StartTime: at(20)},
+		{Subscription: 6, Title: "Debatten", Channel: "NRK1", StartTime: at(20)},
+	}
+	selectRecordings(matches)
+
+	want := map[int64][]bool{1: {true}, 2: {false}, 3: {true, false}, 4: {true}, 5: {false}, 6: {false}}
+	got := make(map[int64][]bool)
+	for _, m := range matches {
+		got[m.Subscription] = append(got[m.Subscription], m.Record)
+	}
+	for sub, records := range want {
+		for i, record := range records {
+			if i >= len(got[sub]) || got[sub][i] != record {
+				t.Errorf("subscription %d: Record = %v, want %v", sub, got[sub], records)
+				break
+			}
+		}
+	}
+}
+
+func TestSubscriptionCoversTimeDst(t *testing.T) {
+	// Summer time starts 2026-03-29 at 02:00 and ends 2026-10-25 at 03:00 in
+	// Oslo, and the subscriptions follow the clock on the wall.
+	config.TimeZone = "Europe/Oslo"
+	loadLocation()
+	defer func() {
+		config.TimeZone = ""
+		loadLocation()
+	}()
+	utc := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2026, month, day, hour, min, 0, 0, time.UTC)
+	}
+	night := Subscription{Day: 0, Hour: 2, Size: 1}
+	evening := Subscription{Day: 0, Hour: 20, Size: 0}
+	tests := []struct {
+		sub  Subscription
+		t    time.Time
+		want bool
+	}{
+		// 01:00 to 03:00 on the night the clock skips 02:00 to 03:00.
+		{night, utc(3, 28, 23, 30), false}, // 00:30
+		{night, utc(3, 29, 0, 0), true},    // 01:00
+		{night, utc(3, 29, 0, 59), true},   // 01:59
+		{night, utc(3, 29, 1, 0), true},    // 03:00 summer time
+		{night, utc(3, 29, 1, 30), false},  // 03:30
+		// And on the night 02:00 to 03:00 comes twice.
+		{night, utc(10, 24, 23, 0), true},  // 01:00 summer time
+		{night, utc(10, 25, 0, 30), true},  // 02:30 summer time
+		{night, utc(10, 25, 1, 30), true},  // 02:30 again
+		{night, utc(10, 25, 2, 0), true},   // 03:00
+		{night, utc(10, 25, 2, 30), false}, // 03:30
+		// The same hour each Sunday, before and after the changes.
+		{evening, utc(3, 22, 19, 0), true},   // 20:00
+		{evening, utc(3, 29, 18, 0), true},   // 20:00 summer time
+		{evening, utc(3, 29, 19, 0), false},  // 21:00 summer time
+		{evening, utc(10, 18, 18, 0), true},  // 20:00 summer time
+		{evening, utc(10, 25, 19, 0), true},  // 20:00
+		{evening, utc(10, 25, 18, 0), false}, // 19:00
+	}
+	for _, test := range tests {
+		if got := subscriptionCoversTime(test.sub, test.t); got != test.want {
+			t.Errorf("subscriptionCoversTime(%d:00, %v) = %v, want %v", test.sub.Hour, test.t.In(getLocation()), got, test.want)
+		}
+	}
+}
+
+func TestRecordingWaitDst(t *testing.T) {
+	oslo, err := time.LoadLocation("Europe/Oslo")
+	if err != nil {
+		t.Skip("No time zone data:", err)
+	}
+	local := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2026, month, day, hour, min, 0, 0, oslo)
+	}
+	tests := []struct {
+		start, stop, now time.Time
+		inFuture         time.Duration
+		duration         time.Duration
+	}{
+		// 01:30 to 03:30 on the clock is an hour when summer time starts,
+		{local(3, 29, 1, 30), local(3, 29, 3, 30), local(3, 29, 1, 0), 30 * time.Minute, time.Hour},
+		// and three when it ends.
+		{local(10, 25, 1, 30), local(10, 25, 3, 30), local(10, 25, 1, 0), 30 * time.Minute, 3 * time.Hour},
+		// Planned the evening before, the wait is an hour shorter or longer.
+		{local(3, 29, 9, 0), local(3, 29, 10, 0), local(3, 28, 21, 0), 11 * time.Hour, time.Hour},
+		{local(10, 25, 9, 0), local(10, 25, 10, 0), local(10, 24, 21, 0), 13 * time.Hour, time.Hour},
+		// Already started, so only the rest is recorded.
+		{local(10, 25, 1, 30), local(10, 25, 3, 30), local(10, 25, 3, 0), -2*time.Hour - 30*time.Minute, 30 * time.Minute},
+	}
+	for _, test := range tests {
+		inFuture, duration := getRecordingWait(test.start, test.stop, test.now)
+		if inFuture != test.inFuture || duration != test.duration {
+			t.Errorf("getRecordingWait(%v, %v, %v) = %v, %v, want %v, %v",
+				test.start, test.stop, test.now, inFuture, duration, test.inFuture, test.duration)
+		}
+	}
+}
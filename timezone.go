@@ -0,0 +1,182 @@
+package main
+
+import (
+	auth "github.com/abbot/go-http-auth"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The time zone of the server, which the channels broadcast in and the
+// subscriptions are given in. Users may see times in their own time zone.
+// It changes on SIGHUP, so it is read with getLocation.
+var location = time.Local
+var locationLock sync.RWMutex
+
+// Time zones suggested on the settings page, any other may be typed in.
+var commonTimeZones = []string{
+	"Europe/Oslo",
+	"Europe/Stockholm",
+	"Europe/Copenhagen",
+	"Europe/Helsinki",
+	"Europe/London",
+	"Europe/Berlin",
+	"Europe/Madrid",
+	"America/New_York",
+	"America/Los_Angeles",
+	"Asia/Bangkok",
+	"Australia/Sydney",
+	"UTC",
+}
+
+func loadLocation() {
+	loc := time.Local
+	if config.TimeZone != "" {
+		var err error
+		loc, err = time.LoadLocation(config.TimeZone)
+		if err != nil {
+			logMessage("warn", "Could not load time zone "+config.TimeZone+", using local time", err)
+			loc = time.Local
+		}
+	}
+	locationLock.Lock()
+	location = loc
+	locationLock.Unlock()
+}
+
+func getLocation() *time.Location {
+	locationLock.RLock()
+	defer locationLock.RUnlock()
+	return location
+}
+
+func getUserLocation(username string) *time.Location {
+	// We'll use the DB, so ensure it is up.
+	ensureDbhConnection()
+
+	var tz string
+	err := dbh.QueryRow("SELECT coalesce(timezone, '') FROM user_settings WHERE username = $1", username).Scan(&tz)
+	if err != nil || tz == "" {
+		return getLocation()
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		logMessage("warn", "Could not load time zone of "+username, err)
+		return getLocation()
+	}
+	return loc
+}
+
+func setUserTimeZone(username, tz string) error {
+	// Check that it is a time zone we know, or empty for the one of the server.
+	if tz != "" {
+		if _, err := time.LoadLocation(tz); err != nil {
+			return err
+		}
+	}
+
+	// We'll use the DB, so ensure it is up.
+	ensureDbhConnection()
+
+	_, err := dbh.Exec(`INSERT INTO user_settings(username, timezone) VALUES ($1, $2)
+                      ON CONFLICT (username) DO UPDATE SET timezone = EXCLUDED.timezone`, username, tz)
+	return err
+}
+
+func parseTimeInput(s string, loc *time.Location) (time.Time, error) {
+	// Links carry the offset, so they are right also when the clock is set back.
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02 15:04", s, loc)
+}
+
+func (e EPG) In(loc *time.Location) EPG {
+	// Only what is shown changes, StartTime stays on the clock of the server as
+	// subscriptions are made from its hour and weekday.
+	e.Start = e.StartTime.In(loc).Format("15:04")
+	e.Stop = e.StopTime.In(loc).Format("15:04")
+	e.StartLong = e.StartTime.In(loc).Format("2006-01-02 15:04")
+	e.StopLong = e.StopTime.In(loc).Format("2006-01-02 15:04")
+	return e
+}
+
+func (r Recording) In(loc *time.Location) Recording {
+	r.StartTime = r.StartTime.In(loc)
+	r.StopTime = r.StopTime.In(loc)
+	r.Start = r.StartTime.Format("2006-01-02 15:04")
+	r.Stop = r.StopTime.Format("15:04")
+	return r
+}
+
+func (m SubscriptionMatch) In(loc *time.Location) SubscriptionMatch {
+	m.StartTime = m.StartTime.In(loc)
+	m.StopTime = m.StopTime.In(loc)
+	m.Start = m.StartTime.Format("2006-01-02 15:04")
+	m.Stop = m.StopTime.Format("2006-01-02 15:04")
+	return m
+}
+
+func settingsPageHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	if r.Method == "POST" && r.FormValue("renew_token") != "" {
+		_, err := getPlaylistToken(r.Username, true)
+		if err != nil {
+			logMessage("warn", "Could not renew playlist token", err)
+			http.Error(w, "Kunne ikke lage ny nøkkel", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, &(r.Request), config.BaseUrl+"settings", 302)
+		return
+	}
+	if r.Method == "POST" && r.FormValue("notifications") != "" {
+		s := NotifySettings{Email: r.FormValue("email"), Ntfy: r.FormValue("ntfy"), Events: r.Form["events"]}
+		err := setNotifySettings(r.Username, s)
+		if err != nil {
+			logMessage("warn", "Could not save notification settings", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, &(r.Request), config.BaseUrl+"settings", 302)
+		return
+	}
+	if r.Method == "POST" {
+		err := setUserTimeZone(r.Username, r.FormValue("timezone"))
+		if err != nil {
+			logMessage("warn", "Could not save time zone", err)
+			http.Error(w, "Ukjent tidssone", http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, &(r.Request), config.BaseUrl+"settings", 302)
+		return
+	}
+
+	loc := getUserLocation(r.Username)
+	d := make(map[string]interface{})
+	d["BaseUrl"] = config.BaseUrl
+	d["Title"] = "Innstillinger"
+	d["User"] = r.Username
+	d["Admin"] = isAdmin(r.Username)
+	d["TimeZone"] = loc.String()
+	d["ServerTimeZone"] = getLocation().String()
+	d["TimeZones"] = commonTimeZones
+	d["Now"] = time.Now().In(loc).Format("2006-01-02 15:04")
+	d["Favourites"] = getUserChannels(r.Username, "", true)
+	d["EventTypes"] = eventTypes
+	d["Email"] = config.SMTPServer != ""
+	d["Ntfy"] = config.NtfyServer
+	if notify, err := getNotifySettings(r.Username); err == nil {
+		d["Notify"] = notify
+	} else {
+		logMessage("warn", "Could not get notification settings", err)
+	}
+	if token, err := getPlaylistToken(r.Username, false); err == nil {
+		d["PlaylistUrl"] = getExternalUrl("playlist.m3u?token=" + token)
+		d["CalendarUrl"] = getExternalUrl("calendar.ics?token=" + token)
+		if config.HDHomeRunTuners > 0 {
+			d["TunerUrl"] = getExternalUrl("hdhomerun/" + token)
+		}
+	} else {
+		logMessage("warn", "Could not get playlist token", err)
+	}
+	w.Write(getPage("settings.html", d))
+}
@@ -13,29 +13,44 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
 
 type Channel struct {
-	Name     string
-	Address  string
-	Running  bool
-	Outgoing string
-	Views    string
-	EPGlist  []EPG
+	Id      int64
+	Name    string
+	Number  int
+	Address string
+	// Sources to switch to, in order, if the address stops delivering data.
+	Fallbacks []string
+	Group     string
+	Logo      string
+	EPGId     string
+	// The DVB service of the channel, if the stream has several.
+	ServiceId int
+	Favourite bool   `json:"-"`
+	Running   bool   `json:"-"`
+	Outgoing  string `json:"-"`
+	Views     string `json:"-"`
+	EPGlist   []EPG  `json:"-"`
 }
 
 type File struct {
-	Name string
-	Size int64
-	Url  string
-	SUrl string
+	Name     string
+	Size     int64
+	Url      string
+	SUrl     string
+	Followed bool
+	// Whether the user may delete it, being its owner or an admin.
+	Deletable bool
 }
 
 type User struct {
@@ -44,6 +59,7 @@ type User struct {
 }
 
 type Config struct {
+	// Only used to fill the channels in the DB the first time.
 	Channels         *[]Channel
 	Hostname         string
 	HttpUser         string
@@ -63,6 +79,49 @@ type Config struct {
 	CubemapStatsFile string
 	CubemapPort      int
 	AutoStopInterval int
+	Admins           []string
+	// Minutes between each check of the subscriptions.
+	SubscriptionInterval int
+	// XMLTV files or URLs, and hours between each import of them.
+	EPGSources        []string
+	EPGImportInterval int
+	EPGKeepDays       int
+	EPGFetchDays      int
+	// Days ahead of EPG-data held in memory, and minutes between reloading it.
+	EPGCacheDays     int
+	EPGCacheInterval int
+	// Channels to read EPG from the DVB stream of, every EITInterval minutes
+	// for EITListen seconds each.
+	EITChannels []string
+	EITInterval int
+	EITListen   int
+	// The priority of each EPG source, e.g. "xmltv" and "eit".
+	EPGPriority map[string]int
+	// The time zone of the server, e.g. "Europe/Oslo", if not the one of the system.
+	TimeZone string
+	// Times to try resolving addresses like hls+master://, before giving up.
+	ResolverRetries int
+	// Seconds without data before switching to the next source of a channel,
+	// and between each check of whether the first source is back.
+	FailoverTimeout  int
+	FailbackInterval int
+	// Tuners to emulate for media servers, 0 to not emulate a HDHomeRun.
+	HDHomeRunTuners   int
+	HDHomeRunDeviceId string
+	// Where events are posted, and how many times to try each.
+	Webhooks       []Webhook
+	WebhookRetries int
+	// The SMTP server, host:port, and the ntfy server, e.g. https://ntfy.sh,
+	// users may be notified through.
+	SMTPServer string
+	SMTPUser   string
+	SMTPPass   string
+	SMTPFrom   string
+	NtfyServer string
+	// MB free for the recordings below which the admins are warned.
+	DiskSpaceWarning int
+	// Needed by Prometheus to read /metrics, which is open if not set.
+	MetricsToken string
 }
 
 type Command struct {
@@ -70,15 +129,29 @@ type Command struct {
 	Cmd       *exec.Cmd
 	Transcode int
 	Address   string
+	// Of the VLC, read here rather than from Cmd, which it is started on.
+	Pid int
 }
 
 type EPG struct {
 	Title       string
+	Channel     string
 	Start       string
 	Stop        string
 	StartLong   string
 	StopLong    string
 	Description string
+	SubTitle    string
+	EpisodeNum  string
+	Episode     string
+	Categories  []string
+	Rating      string
+	Credits     []Credit
+	Icon        string
+	// The credits as in XMLTV, by role.
+	CreditRoles map[string][]string `json:"-"`
+	StartTime   time.Time
+	StopTime    time.Time
 }
 
 type Recording struct {
@@ -89,7 +162,16 @@ type Recording struct {
 	Title       string
 	User        string
 	Transcoding string
-	Cmd         *exec.Cmd
+	Episode     string
+	SubTitle    string
+	EpisodeNum  string
+	// The subscription this is recorded for, 0 if recorded manually.
+	Subscription int64
+	Cmd          *exec.Cmd `json:"-"`
+	// Of the VLC once it has started, set under recordingsLock.
+	Pid       int `json:"-"`
+	StartTime time.Time
+	StopTime  time.Time
 }
 
 type Subscription struct {
@@ -98,15 +180,97 @@ type Subscription struct {
 	StartTime string
 	Weekday   string
 	Channel   string
+	Category  string
+	NewOnly   bool
+	Username  string
+	Day       int
+	Hour      int
+	Size      int
+	// When the subscription will be recorded next, if known.
+	NextAiring string
+	Followers  int
+	// The preferences of the user looking at the subscription.
+	Follower Follower
 }
 
 var config Config
 
+// The running streams and planned recordings, used by the handlers, the
+// scheduler and the recordings in the background, so only through the
+// functions below.
 var streams = make(map[string]Command)
 var recordings = make(map[int64]Recording)
+var streamsLock, recordingsLock sync.RWMutex
 var cubemapDeleteQueue = make(map[string]bool)
 var dbh *sql.DB
 
+func getStream(username string) (Command, bool) {
+	streamsLock.RLock()
+	defer streamsLock.RUnlock()
+	stream, ok := streams[username]
+	return stream, ok
+}
+
+// A snapshot of the streams, which may be ranged over while they change.
+func getStreams() map[string]Command {
+	streamsLock.RLock()
+	defer streamsLock.RUnlock()
+	snapshot := make(map[string]Command, len(streams))
+	for username, stream := range streams {
+		snapshot[username] = stream
+	}
+	return snapshot
+}
+
+func setStream(username string, stream Command) {
+	streamsLock.Lock()
+	defer streamsLock.Unlock()
+	streams[username] = stream
+}
+
+func deleteStream(username string) {
+	streamsLock.Lock()
+	defer streamsLock.Unlock()
+	delete(streams, username)
+}
+
+func getRecording(id int64) (Recording, bool) {
+	recordingsLock.RLock()
+	defer recordingsLock.RUnlock()
+	recording, ok := recordings[id]
+	return recording, ok
+}
+
+// A snapshot of the recordings, which may be ranged over while they change.
+func getRecordings() map[int64]Recording {
+	recordingsLock.RLock()
+	defer recordingsLock.RUnlock()
+	snapshot := make(map[int64]Recording, len(recordings))
+	for id, recording := range recordings {
+		snapshot[id] = recording
+	}
+	return snapshot
+}
+
+// Adds the recording, unless it is already planned and so has its own VLC.
+func addRecording(recording Recording) bool {
+	recordingsLock.Lock()
+	defer recordingsLock.Unlock()
+	if _, ok := recordings[recording.Id]; ok {
+		return false
+	}
+	recordings[recording.Id] = recording
+	return true
+}
+
+func deletePlannedRecording(id int64) Recording {
+	recordingsLock.Lock()
+	defer recordingsLock.Unlock()
+	recording := recordings[id]
+	delete(recordings, id)
+	return recording
+}
+
 func ensureDbhConnection() {
 	var err error
 	if dbh == nil {
@@ -116,20 +280,19 @@ func ensureDbhConnection() {
 			logMessage("error", "Could not initialize DB-connection", err)
 		}
 	}
-	for connerr := dbh.Ping(); connerr != nil; {
-		// We can't seem to get a connection. Try to get it.
-		dbh, err = getDatabaseHandler()
-		if err != nil {
-			// And we try again and again, until it responds.
-			logMessage("warn", "Can't connect to the Postgresql DB, trying again in 2 seconds", err)
-			time.Sleep(2 * time.Second)
-		}
+	// The handler connects again by itself, so we try again and again, until it responds.
+	for err = dbh.Ping(); err != nil; err = dbh.Ping() {
+		logMessage("warn", "Can't connect to the Postgresql DB, trying again in 2 seconds", err)
+		time.Sleep(2 * time.Second)
 	}
 }
 
+func getDatabaseOptions() string {
+	return fmt.Sprintf("host=%v dbname=%v user= %v password=%v sslmode=disable", config.DBHost, config.DBName, config.DBUser, config.DBPass)
+}
+
 func getDatabaseHandler() (*sql.DB, error) {
-	dboptions := fmt.Sprintf("host=%v dbname=%v user= %v password=%v sslmode=disable", config.DBHost, config.DBName, config.DBUser, config.DBPass)
-	dbh, err := sql.Open("postgres", dboptions)
+	dbh, err := sql.Open("postgres", getDatabaseOptions())
 	if err != nil {
 		return nil, err
 	}
@@ -152,13 +315,6 @@ func loadConfig(filename string) Config {
 	if err != nil {
 		logMessage("error", "Problemer med å pakke ut config", err)
 	}
-
-	// Check if any channels are empty and notify in that case.
-	for _, channel := range *(config.Channels) {
-		if channel.Address == "" {
-			logMessage("warn", fmt.Sprintf("Channel '%s' is empty, either edit your config or run NRK script in contrib", channel.Name), nil)
-		}
-	}
 	return config
 }
 
@@ -208,8 +364,6 @@ func getNorwegianWeekday(day int) string {
 func loadPlannedRecordings() error {
 	ensureDbhConnection()
 
-	long_form := "2006-01-02 15:04"
-
 	// First delete those that have finished since last time.
 	rows, err := dbh.Query("SELECT id FROM recordings WHERE stop < now()")
 	if err != nil {
@@ -219,13 +373,13 @@ func loadPlannedRecordings() error {
 	for rows.Next() {
 		var id int64
 		_ = rows.Scan(&id)
-		err := removeRecording(id)
+		_, err := removeRecording(id)
 		if err != nil {
 			return err
 		}
 	}
 
-	rows, err = dbh.Query("SELECT start,stop,username,title,channel,transcode FROM recordings")
+	rows, err = dbh.Query("SELECT start,stop,username,title,channel,transcode,coalesce(subscription_id, 0) FROM recordings")
 	if err != nil {
 		return err
 	}
@@ -234,15 +388,20 @@ func loadPlannedRecordings() error {
 	for rows.Next() {
 		var username, title, channel, transcode string
 		var start, stop time.Time
-		rows.Scan(&start, &stop, &username, &title, &channel, &transcode)
-		go startRecording(start.Format(long_form), stop.Format(long_form), username, title, channel, transcode)
+		var subscription int64
+		rows.Scan(&start, &stop, &username, &title, &channel, &transcode, &subscription)
+		_, err := startRecording(start, stop, username, title, channel, transcode, subscription)
+		if err != nil {
+			logMessage("warn", "Could not start recording of "+title, err)
+			continue
+		}
 		cnt += 1
 	}
 	logMessage("info", fmt.Sprintf("Loaded %d recordings from DB", cnt), nil)
 	return nil
 }
 
-func insertRecording(username, title, channel, transcode string, start, stop time.Time) (int64, error) {
+func insertRecording(username, title, channel, transcode, episode string, subscription int64, start, stop time.Time) (int64, error) {
 	// We'll use the DB, so ensure it is up.
 	ensureDbhConnection()
 
@@ -256,9 +415,9 @@ func insertRecording(username, title, channel, transcode string, start, stop tim
 	if err == sql.ErrNoRows {
 		// Great the recording does not exist in the DB yet, lets insert it.
 		err := dbh.QueryRow(`INSERT INTO recordings(
-    start,stop,username,title,channel,transcode) VALUES
-    ($1,$2,$3,$4,$5,$6) RETURNING id`,
-			start, stop, username, title, channel, transcode).Scan(&id)
+    start,stop,username,title,channel,transcode,episode_key,subscription_id) VALUES
+    ($1,$2,$3,$4,$5,$6,$7,$8) RETURNING id`,
+			start, stop, username, title, channel, transcode, episode, nullId(subscription)).Scan(&id)
 		if err != nil {
 			return id, err
 		}
@@ -271,34 +430,48 @@ func insertRecording(username, title, channel, transcode string, start, stop tim
 	return id, nil
 }
 
-func removeRecording(id int64) error {
+func removeRecording(id int64) (Recording, error) {
 	// We'll use the DB, so ensure it is up.
 	ensureDbhConnection()
 
 	tx, _ := dbh.Begin()
 	_, err := tx.Exec("DELETE FROM recordings WHERE id = $1", id)
 	if err != nil {
-		return err
+		return Recording{}, err
 	}
 	_ = tx.Commit()
 
-	// Delete from cmd and kill command.
-	delete(recordings, id)
-	return nil
+	// Delete from the planned recordings, which are not started after this.
+	recording := deletePlannedRecording(id)
+	notifyLive()
+	return recording, nil
 }
 
-func getVLCstr(transcoding int, address, dst, access string) string {
+func getVLCArgs(transcoding int, address, dst, access string) []string {
+	// VLC is run without a shell, as the address may come from a remote playlist.
 	transcoding_opts := fmt.Sprintf("#transcode{vcodec=mp2v,vb=%v,acodec=aac,ab=128,scale=0.7,threads=2}:", transcoding)
-	output := fmt.Sprintf("std{access=%v,mux=ts,dst=%v}'", access, dst)
-	command := fmt.Sprintf("cvlc '%v' --sout '", address)
+	output := fmt.Sprintf("std{access=%v,mux=ts,dst=%v}", access, dst)
 
+	sout := "#"
 	if transcoding != 0 {
-		command += transcoding_opts
-	} else {
-		command += "#"
+		sout = transcoding_opts
 	}
-	command += output
-	return command
+	return []string{"cvlc", address, "--sout", sout + output}
+}
+
+// The kinds of addresses VLC may be given from outside the channel list.
+var streamSchemes = map[string]bool{
+	"http": true, "https": true, "udp": true, "rtp": true, "rtsp": true, "mms": true,
+	"hls+master": true, "hls+master+http": true,
+}
+
+func validStreamAddress(address string) bool {
+	// A stream over the network, and not e.g. a local file or a VLC option.
+	u, err := url.Parse(address)
+	if err != nil || strings.HasPrefix(address, "-") {
+		return false
+	}
+	return streamSchemes[strings.ToLower(u.Scheme)]
 }
 
 func startUniStream(channel Channel, user User, transcoding int, access string) (*exec.Cmd, error) {
@@ -306,24 +479,38 @@ func startUniStream(channel Channel, user User, transcoding int, access string)
 
 	userPort := getUserPort(user)
 	userSuffix := fmt.Sprintf(":%d/%v", userPort, user.Name)
-	command := getVLCstr(transcoding, channel.Address, userSuffix, access)
-	cmd = exec.Command("bash", "-c", command)
-	err := cmd.Start()
+
+	// With several sources, we feed VLC from the one that works.
+	if len(channel.Sources()) > 1 {
+		args := getVLCArgs(transcoding, "-", userSuffix, access)
+		cmd = exec.Command(args[0], args[1:]...)
+		return cmd, startFeeder(cmd, "stream:"+user.Name, channel)
+	}
+
+	// Tokenised addresses are resolved each time, as they expire.
+	address, err := resolveAddress(channel.Address)
+	if err != nil {
+		return nil, err
+	}
+	args := getVLCArgs(transcoding, address, userSuffix, access)
+	cmd = exec.Command(args[0], args[1:]...)
+	err = cmd.Start()
 	return cmd, err
 }
 
 func killUniStream(user User) error {
 	logMessage("info", "Killing stream for user '"+user.Name+"'", nil)
-	if _, ok := streams[user.Name]; ok {
+	if stream, ok := getStream(user.Name); ok {
 		// Kill the VLC-process running this channel.
-		err := killStream(streams[user.Name].Cmd)
+		err := killStream(stream.Cmd)
 		if err != nil {
 			return err
 		}
 	}
 
 	// Delete from "currently playing hashmap"
-	delete(streams, user.Name)
+	deleteStream(user.Name)
+	notifyLive()
 
 	// Kind of funky, but since cubemap want to set src=delete we need to record
 	// that this channel indeed has been stopped.
@@ -339,6 +526,8 @@ func killUniStream(user User) error {
 }
 
 func killStream(cmd *exec.Cmd) error {
+	// Stop reading the sources of the channel, if it has several.
+	stopFeeder(cmd)
 	if err := cmd.Process.Kill(); err != nil {
 		return err
 	}
@@ -359,6 +548,14 @@ func getUserPort(u User) int {
 	return base + u.Id
 }
 
+func getUserURL(user User) string {
+	// Get the URL for this user.
+	if config.CubemapConfig != "" {
+		return fmt.Sprintf("http://%s:%d/%s", config.Hostname, config.CubemapPort, user.Name)
+	}
+	return fmt.Sprintf("http://%v:%d/%v", config.Hostname, getUserPort(user), user.Name)
+}
+
 func getUserFromName(username string) (User, error) {
 	// Creates a User-object and gives ID based on placement in PasswordFile.
 	f, err := ioutil.ReadFile(config.PasswordFile)
@@ -376,13 +573,29 @@ func getUserFromName(username string) (User, error) {
 	return User{}, errors.New("Did not find user '" + username + "' authenticated from Basic Auth.")
 }
 
+func getUsers() ([]User, error) {
+	// The users in the order of the PasswordFile, which gives their ids.
+	f, err := ioutil.ReadFile(config.PasswordFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []User
+	lines := strings.Split(string(f), "\n")
+	for id, line := range lines[0 : len(lines)-1] {
+		s := strings.SplitN(line, ":", 2)
+		users = append(users, User{Name: s[0], Id: id})
+	}
+	return users, nil
+}
+
 func getUserFromRequest(r *auth.AuthenticatedRequest) (User, error) {
 	return getUserFromName(r.Username)
 }
 
 func getChannel(channel_name, username string) (*Channel, error) {
-	// Check if the channel is defined in the config-file.
-	arr := *(config.Channels)
+	// Check if the channel is defined in the DB.
+	arr := getChannels()
 	for i, _ := range arr {
 		if arr[i].Name == channel_name {
 			return &(arr[i]), nil
@@ -390,8 +603,7 @@ func getChannel(channel_name, username string) (*Channel, error) {
 	}
 
 	// Check if the user is running a stream, that perhaps is not in the config file.
-	if _, ok := streams[username]; ok {
-		s := streams[username]
+	if s, ok := getStream(username); ok {
 		return &(Channel{Name: s.Name, Address: s.Address}), nil
 	}
 
@@ -399,159 +611,150 @@ func getChannel(channel_name, username string) (*Channel, error) {
 	return &(Channel{}), errors.New("Did not find specified channel name")
 }
 
-func getEpgData(numEpg int) {
-	// We'll use the DB, so ensure it is up.
-	ensureDbhConnection()
-
-	for i, _ := range *(config.Channels) {
-		arr := *(config.Channels)
-		arr[i].EPGlist = []EPG{}
-		rows, err := dbh.Query(`SELECT title, start, stop, description
-                            FROM epg
-                            WHERE channel=$1
-                            AND stop > now()
-                            LIMIT $2`, arr[i].Name, numEpg)
-		if err != nil {
-			logMessage("warn", "Could not fetch EPG-data from DB", err)
-			return
-		}
-		for rows.Next() {
-			var title, description string
-			var start, stop time.Time
-			err = rows.Scan(&title, &start, &stop, &description)
-			if err != nil {
-				logMessage("error", "Could not get EPG-data from DB", err)
-				return
-			}
-			short_form := "15:04"
-			long_form := "2006-01-02 15:04"
-			epg := EPG{
-				Title:       title,
-				Start:       start.Format(short_form),
-				Stop:        stop.Format(short_form),
-				StartLong:   start.Format(long_form),
-				StopLong:    stop.Format(long_form),
-				Description: description,
-			}
-			arr[i].EPGlist = append(arr[i].EPGlist, epg)
-		}
-	}
-}
-
-func stopRecordingHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
-	id, err := strconv.Atoi(r.FormValue("id"))
-	if err != nil {
-		logMessage("error", "Could not convert recording-id to int", err)
-		http.Redirect(w, &(r.Request), config.BaseUrl, 302)
-	}
-
-	// Remove the recording from the database
-	err = removeRecording(int64(id))
+func stopRecording(id int64) error {
+	// Remove the recording from the database, and stop it if it has started.
+	recording, err := removeRecording(id)
 	if err != nil {
-		logMessage("error", "Could not remove recording", err)
-		http.Redirect(w, &(r.Request), config.BaseUrl, 302)
+		return err
 	}
-
-	if _, ok := recordings[int64(id)]; ok {
-		_ = killStream(recordings[int64(id)].Cmd)
+	if recording.Pid != 0 {
+		return killStream(recording.Cmd)
 	}
-	http.Redirect(w, &(r.Request), config.BaseUrl, 302)
+	return nil
 }
 
-func startRecording(sstart, sstop, username, title, channel, transcode string) {
-	// Parse the time.
-	layout := "2006-01-02 15:04"
-	short_layout := "15:04"
-	file_layout := "2006-01-02-15-04"
-	start, err := time.Parse(layout, sstart)
-	stop, err := time.Parse(layout, sstop)
-	if err != nil {
-		logMessage("warn", "Could not parse time and thus not start recording", err)
-		return
+// How long until the recording starts, and how long it runs from then. The
+// times are absolute, so this is right also when the clock changes.
+func getRecordingWait(start, stop, now time.Time) (inFuture, duration time.Duration) {
+	duration = stop.Sub(start)
+	inFuture = start.Sub(now)
+	if inFuture < 0 {
+		// Programme has already started.
+		duration = stop.Sub(now)
 	}
+	return inFuture, duration
+}
 
-	// Go assumes UTC, and as we are on Go 1.0 and not 1.1 we dont have ParseInLocation.
-	// Thus we just convert now-time to UTC and add appropriate hours, based on local time zone.
-	_, inFuture := time.Now().Zone()
-	oslo := time.Now().UTC().Add(time.Duration(time.Duration(inFuture) * time.Second))
+// The same programme is only recorded once, by the first to plan it.
+var errRecordingPlanned = errors.New("The recording is already planned")
 
-	duration := stop.Sub(start).Seconds()
-	secondsInFuture := start.Sub(oslo).Seconds()
-	if secondsInFuture < 0 {
-		// Programme has already started.
-		duration = stop.Sub(oslo).Seconds()
-	}
+func startRecording(start, stop time.Time, username, title, channel, transcode string, subscription int64) (int64, error) {
+	file_layout := "2006-01-02-15-04"
 
+	now := time.Now()
+	inFuture, duration := getRecordingWait(start, stop, now)
 	if duration < 0 {
-		logMessage("warn", "Starting recording failed due to negative duration", err)
-		return
-	}
-
-	// Add the recording to the array of recordings for this user.
-	programme_title := strings.Replace(title, " ", "-", -1)
-	filename := fmt.Sprintf("%v/%v-%v-%v.mkv", config.RecordingsFolder, time.Now().Format(file_layout), programme_title, username)
-	id, err := insertRecording(username, title, channel, transcode, start, stop)
-	if err != nil {
-		logMessage("warn", "Could not insert recording", err)
-		return
+		return 0, errors.New("The recording has a negative duration")
 	}
 
 	// Get the channel for this recording
 	ch, err := getChannel(channel, username)
 	if err != nil {
-		logMessage("warn", "Could not get channel in order to start recording", err)
-		return
-	}
-	command := getVLCstr(0, ch.Address, filename, "file")
-	cmd := exec.Command("bash", "-c", command)
-	recordings[id] = Recording{
-		Id:          id,
-		User:        username,
-		Title:       programme_title,
-		Start:       start.Format(layout),
-		Stop:        stop.Format(short_layout),
-		Channel:     channel,
-		Transcoding: transcode,
-		Cmd:         cmd,
+		return 0, err
 	}
 
-	if !(secondsInFuture <= 0) {
-		// Wait until programme starts.
-		time.Sleep(time.Duration(int(secondsInFuture)) * time.Second)
-	}
-
-	// Start the recording and save to disk.
-	err = cmd.Start()
+	// Add the recording to the array of recordings for this user.
+	programme_title := strings.Replace(title, " ", "-", -1)
+	filename := fmt.Sprintf("%v/%v-%v-%v.mkv", config.RecordingsFolder, now.In(getLocation()).Format(file_layout), programme_title, username)
+	programme, _ := epgCache.Lookup(title, channel, start)
+	episode := episodeKey(programme.EpisodeNum, programme.SubTitle, programme.Description)
+	id, err := insertRecording(username, title, channel, transcode, episode, subscription, start, stop)
 	if err != nil {
-		logMessage("warn", "Could not start VLC-command", err)
-		return
-	}
-
-	// Wait until programme stops.
-	time.Sleep(time.Duration(int(duration)) * time.Second)
+		return 0, err
+	}
+	// The command gets its arguments when the recording starts, below.
+	cmd := exec.Command("cvlc")
+	added := addRecording(Recording{
+		Id:           id,
+		User:         username,
+		Title:        programme_title,
+		Channel:      channel,
+		Transcoding:  transcode,
+		Episode:      episode,
+		SubTitle:     programme.SubTitle,
+		EpisodeNum:   programme.Episode,
+		Subscription: subscription,
+		Cmd:          cmd,
+		StartTime:    start,
+		StopTime:     stop,
+	}.In(getLocation()))
+	if !added {
+		return id, errRecordingPlanned
+	}
+	notifyLive()
+
+	// The rest is done in the background, until the programme ends.
+	go func() {
+		if inFuture > 0 {
+			// Wait until programme starts.
+			time.Sleep(inFuture)
+		}
+		// Tokenised addresses are resolved when the recording starts, as they expire.
+		var address string
+		var err error
+		if len(ch.Sources()) > 1 {
+			address = "-"
+		} else {
+			address, err = resolveAddress(ch.Address)
+		}
 
-	// Kill the recording.
-	err = killStream(cmd)
-	if err != nil {
-		logMessage("error", "Could not kill recording", err)
-	}
+		// Start the recording and save to disk, from the source that works if several.
+		// This is done under the lock, so it is either stopped before it starts,
+		// or stopped with the VLC started.
+		recordingsLock.Lock()
+		if _, ok := recordings[id]; !ok {
+			// Stopped by a user before it started.
+			recordingsLock.Unlock()
+			return
+		}
+		if err == nil {
+			cmd.Args = getVLCArgs(0, address, filename, "file")
+			if address == "-" {
+				err = startFeeder(cmd, fmt.Sprintf("recording:%d", id), *ch)
+			} else {
+				err = cmd.Start()
+			}
+		}
+		if err == nil {
+			recording := recordings[id]
+			recording.Pid = cmd.Process.Pid
+			recordings[id] = recording
+		}
+		recordingsLock.Unlock()
+		notifyLive()
+		if err != nil {
+			logMessage("warn", "Could not start VLC-command", err)
+			publishRecordingEvent(EventRecordingFailed, id, username, title, channel, subscription, start, err)
+			removeRecording(id)
+			return
+		}
+		publishRecordingEvent(EventRecordingStarted, id, username, title, channel, subscription, start, nil)
 
-	err = removeRecording(id)
-	if err != nil {
-		logMessage("error", "Could not remove recording", err)
-	}
-}
+		// Wait until programme stops.
+		time.Sleep(duration)
+		if _, ok := getRecording(id); !ok {
+			// Stopped by a user, who should have killed it, but never leave it running.
+			killStream(cmd)
+			return
+		}
 
-func startRecordingHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
-	start := r.FormValue("start")
-	stop := r.FormValue("stop")
-	title := r.FormValue("title")
-	channel := r.FormValue("channel")
-	transcode := r.FormValue("transcode")
-	user, _ := getUserFromRequest(r)
+		// Kill the recording, and remember the episode.
+		err = killStream(cmd)
+		if err != nil {
+			logMessage("warn", "Could not kill recording", err)
+		}
+		err = addEpisodeHistory(title, channel, episode, filename, subscription, start)
+		if err != nil {
+			logMessage("warn", "Could not add recording to episode history", err)
+		}
+		publishRecordingEvent(EventRecordingFinished, id, username, title, channel, subscription, start, nil)
 
-	go startRecording(start, stop, user.Name, title, channel, transcode)
-	http.Redirect(w, &r.Request, config.BaseUrl, 302)
+		_, err = removeRecording(id)
+		if err != nil {
+			logMessage("warn", "Could not remove recording", err)
+		}
+	}()
+	return id, nil
 }
 
 func startVlcHandler(w http.ResponseWriter, r *http.Request) {
@@ -561,26 +764,30 @@ func startVlcHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(getPage("vlc.html", d))
 }
 
-func deleteRecording(name string) error {
-	return os.Remove(config.RecordingsFolder + "/" + name)
-}
-
-func insertSubscription(title string, weekday int, interval []int, channel string, username string) error {
-	// We'll use the DB, so ensure it is up.
-	ensureDbhConnection()
-
-	// Insert the subscription.
-	tx, err := dbh.Begin()
-	_, err = tx.Exec(`INSERT INTO subscriptions(
-	title,interval_start,interval_stop,weekday,channel,username) VALUES
-	($1,$2,$3,$4,$5,$6)`,
-		title, interval[0], interval[1], weekday, channel, username)
+// The user who recorded the file, from the end of the name as given by
+// startRecording, or "" if not known. The title may have dashes as well, so the
+// longest user name matching wins.
+func getRecordingOwner(name string) string {
+	users, err := getUsers()
 	if err != nil {
-		return err
+		logMessage("warn", "Could not read users", err)
+		return ""
 	}
-	tx.Commit()
+	owner := ""
+	for _, u := range users {
+		if strings.HasSuffix(name, "-"+u.Name+".mkv") && len(u.Name) > len(owner) {
+			owner = u.Name
+		}
+	}
+	return owner
+}
 
-	return nil
+func mayDeleteRecording(name, username string) bool {
+	return isAdmin(username) || getRecordingOwner(name) == username
+}
+
+func deleteRecording(name string) error {
+	return os.Remove(config.RecordingsFolder + "/" + name)
 }
 
 func addHoursToInt(h int, d int) int {
@@ -591,107 +798,69 @@ func addHoursToInt(h int, d int) int {
 	return baseTime.Add(dur).Hour()
 }
 
-func startSeriesSubscription(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
-	// Get parameters from form
-	title := r.FormValue("title")
-	channel := r.FormValue("channel")
-	weekday, err := strconv.Atoi(r.FormValue("weekday"))
-	t, err := strconv.Atoi(r.FormValue("time"))
-	if err != nil {
-		logMessage("warn", "Could not parse subscription time", err)
-		http.Redirect(w, &(r.Request), config.BaseUrl, 302)
-	}
-
-	interval := []int{addHoursToInt(t, -config.SubIntervalSize), addHoursToInt(t, config.SubIntervalSize)}
-
-	// Insert the subscription
-	err = insertSubscription(title, weekday, interval, channel, r.Username)
-	if err != nil {
-		logMessage("warn", "Could not insert the subscription", err)
-		http.Redirect(w, &(r.Request), config.BaseUrl, 302)
-	}
-
-	// And check if we should start a recording right away.
-	err = checkSubscriptions()
-	if err != nil {
-		logMessage("warn", "Could not check and refresh the subscriptions", err)
-		http.Redirect(w, &(r.Request), config.BaseUrl, 302)
-	}
-
-	// Redirect to front-page.
-	http.Redirect(w, &(r.Request), config.BaseUrl, 302)
-}
-
-func removeSubscriptionHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
-	// Parse GET-parameters
-	id, err := strconv.Atoi(r.FormValue("id"))
-	if err != nil {
-		logMessage("error", "Could not convert subscription id to int64", err)
-	}
-
-	// Delete the subscription
-	err = removeSubscription(r.Username, int64(id))
-	if err != nil {
-		logMessage("error", "Could not delete the subscription", err)
-	}
-
-	// Redirect to front-page.
-	http.Redirect(w, &(r.Request), config.BaseUrl, 302)
-}
+// Returned when a user changes a subscription he/she does not follow.
+var errNotFollowing = errors.New("A user tried to change a subscription he/she did not follow")
 
 func removeSubscription(username string, id int64) error {
 	// We'll use the DB, so ensure it is up.
 	ensureDbhConnection()
 
-	// Check that the username owns this recording.
-	dbh.QueryRow("SELECT * FROM subscriptions WHERE username = $1 AND id = $2", username, id)
-	if sql.ErrNoRows == nil {
-		return errors.New("A user tried to delete a subscription he/she did not own")
+	tx, err := dbh.Begin()
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback()
 
-	tx, err := dbh.Begin()
+	// Stop following the subscription.
+	res, err := tx.Exec("DELETE FROM subscription_followers WHERE subscription_id = $1 AND username = $2", id, username)
 	if err != nil {
 		return err
 	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errNotFollowing
+	}
 
-	_, err = tx.Exec("DELETE FROM subscriptions WHERE id = $1", id)
+	// And remove the subscription when no one follows it anymore.
+	_, err = tx.Exec(`DELETE FROM subscriptions WHERE id = $1
+                    AND NOT EXISTS (SELECT 1 FROM subscription_followers WHERE subscription_id = $1)`, id)
 	if err != nil {
 		return err
 	}
 	return tx.Commit()
 }
 
-func checkSubscriptions() error {
-	// We'll use the DB, so ensure it is up.
-	ensureDbhConnection()
-
-	// Time stamp used in the recording thread.
-	long_form := "2006-01-02 15:04"
-
-	// A nice query, finding all subscriptions not already in recordings.
-	s := config.SubIntervalSize
-	stmt := fmt.Sprintf(`SELECT epg.start, epg.stop, epg.title, epg.channel, subscriptions.username
-											FROM epg
-											JOIN subscriptions ON epg.title = subscriptions.title
-											WHERE (subscriptions.title, subscriptions.channel) NOT IN (
-											SELECT title, channel FROM recordings
-											)
-											AND epg.start::time - '%d hours'::interval >= (to_char(subscriptions.interval_start, '09') || ':00')::time
-											AND epg.start::time + '%d hours'::interval >= (to_char(subscriptions.interval_stop, '09') || ':00')::time
-											AND extract(dow from epg.start) = subscriptions.weekday
-											AND epg.channel = subscriptions.channel`, s, s)
-	rows, err := dbh.Query(stmt)
+func checkSubscriptions() (int, error) {
+	subs, err := querySubscriptions("")
 	if err != nil {
-		return err
+		return 0, err
 	}
+
+	// Find the upcoming airings of all subscriptions.
+	var matches []SubscriptionMatch
+	for _, sub := range subs {
+		m, err := getSubscriptionMatches(sub)
+		if err != nil {
+			return 0, err
+		}
+		matches = append(matches, m...)
+	}
+
+	// Decide which of them to record, skipping reruns for new-only subscriptions.
+	selectRecordings(matches)
+
 	count := 0
-	for rows.Next() {
-		var title, channel, username string
-		var start, stop time.Time
-		rows.Scan(&start, &stop, &title, &channel, &username)
+	for _, m := range matches {
+		if !m.Record {
+			continue
+		}
 
 		// Start the recording, and for now default to 0 transcoding.
-		go startRecording(start.Format(long_form), stop.Format(long_form), username, title, channel, "0")
+		id, err := startRecording(m.StartTime, m.StopTime, m.Username, m.Title, m.Channel, "0", m.Subscription)
+		if err != nil {
+			logMessage("warn", "Could not start recording of "+m.Title, err)
+			continue
+		}
+		publishRecordingEvent(EventSubscriptionMatched, id, m.Username, m.Title, m.Channel, m.Subscription, m.StartTime, nil)
 
 		count += 1
 	}
@@ -700,55 +869,29 @@ func checkSubscriptions() error {
 		logMessage("info", fmt.Sprintf("Started %d recordings due to subscriptions", count), nil)
 	}
 
-	return nil
-}
-
-func checkSubscriptionsHandler(w http.ResponseWriter, r *http.Request) {
-	err := checkSubscriptions()
-	if err != nil {
-		logMessage("error", "Could not refresh and check subscriptions", err)
-	}
-	// This is accessed by clients, as an API (or whatever) -- so just output something.
-	fmt.Fprintf(w, "Ok.")
+	return count, nil
 }
 
 func getSeriesSubscriptions(username string) ([]Subscription, error) {
-	// We'll use the DB, so ensure it is up.
-	ensureDbhConnection()
-
-	// Get all subs for this user.
-	rows, err := dbh.Query("SELECT id, title, interval_start, interval_stop, weekday, channel FROM subscriptions WHERE username = $1", username)
+	// Get all subs this user follows.
+	subs, err := querySubscriptions(`WHERE s.id IN (
+                                   SELECT subscription_id FROM subscription_followers WHERE username = $1)`, username)
 	if err != nil {
-		logMessage("warn", "Getting titles failed", err)
+		return subs, err
 	}
 
-	var subs []Subscription
-	for rows.Next() {
-		var title, channel string
-		var id, interval_start, interval_stop, weekday int
-		rows.Scan(&id, &title, &interval_start, &interval_stop, &weekday, &channel)
-
-		// Get the zero-padded starttime
-		stime := zeroPad(strconv.Itoa(addHoursToInt(interval_start, config.SubIntervalSize)))
-
-		// Gives more sense that something happens at 00, compared to 24.
-		if stime == "24" {
-			stime = "00"
+	// Find when each of them will be recorded next, and the preferences of this user.
+	loc := getUserLocation(username)
+	for i := range subs {
+		subs[i].Follower, err = getFollower(subs[i].Id, username)
+		if err != nil {
+			logMessage("warn", "Could not get subscription preferences", err)
+		}
+		subs[i].NextAiring, err = getNextAiring(subs[i], loc)
+		if err != nil {
+			logMessage("warn", "Could not get next airing of subscription", err)
 		}
-
-		// Translate the weekdays to Norwegian.
-		weekday_nor := getNorwegianWeekday(weekday)
-
-		// Add the subscription to the array of subscriptions.
-		subs = append(subs, Subscription{
-			Id:        int64(id),
-			Title:     title,
-			StartTime: stime,
-			Weekday:   weekday_nor,
-			Channel:   channel,
-		})
 	}
-
 	return subs, nil
 }
 
@@ -778,33 +921,25 @@ func getAllPrograms() ([]string, error) {
 
 }
 
-func archivePageHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
-	// Check if we requested to delete a file.
-	deleteform := r.FormValue("delete")
-	if deleteform != "" {
-		err := deleteRecording(deleteform)
-		if err != nil {
-			logMessage("warn", "Could not delete recording", err)
-		}
-
-		// File deleted, redirect back to archive.
-		base_url := fmt.Sprintf("%varchive", config.BaseUrl)
-		http.Redirect(w, &r.Request, base_url, 302)
-	}
-
+func getArchiveFiles(username string) ([]File, error) {
 	// Ensure the recordings-folder exists.
 	if _, err := os.Stat(config.RecordingsFolder); err != nil {
 		err := os.Mkdir(config.RecordingsFolder, 0755)
 		if err != nil {
-			logMessage("error", "Could not create recordingsfolder", err)
+			return nil, err
 		}
 	}
 
 	// Get all recordings in the archive folder.
 	recordings, err := ioutil.ReadDir(config.RecordingsFolder)
 	if err != nil {
-		logMessage("error", "Could not list archive", err)
-		return
+		return nil, err
+	}
+
+	// Recordings from subscriptions this user follows are marked.
+	followed, err := getFollowedFiles(username)
+	if err != nil {
+		logMessage("warn", "Could not get recordings of followed subscriptions", err)
 	}
 
 	// Make an empty file.
@@ -815,7 +950,16 @@ func archivePageHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
 		streamurl := baseUrl + config.RecordingsFolder + "/" + file.Name()
 		vlcurl := baseUrl + "vlc?url=" + streamurl
 		// Add the file to array and display MB.
-		fs = append(fs, File{Name: file.Name(), Size: (file.Size() / 1000000), Url: vlcurl, SUrl: streamurl})
+		fs = append(fs, File{Name: file.Name(), Size: (file.Size() / 1000000), Url: vlcurl, SUrl: streamurl, Followed: followed[file.Name()],
+			Deletable: mayDeleteRecording(file.Name(), username)})
+	}
+	return fs, nil
+}
+
+func archivePageHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	fs, err := getArchiveFiles(r.Username)
+	if err != nil {
+		logMessage("warn", "Could not list archive", err)
 	}
 
 	// Map holding our parameters.
@@ -828,7 +972,7 @@ func archivePageHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
 
 func startChannel(ch Channel, u User, transcoding int) error {
 	// First kill current running channel, if any.
-	if _, ok := streams[u.Name]; ok {
+	if _, ok := getStream(u.Name); ok {
 		err := killUniStream(u)
 		if err != nil {
 			return err
@@ -849,12 +993,14 @@ func startChannel(ch Channel, u User, transcoding int) error {
 	logMessage("info", fmt.Sprintf("Started stream '%v' for user '%v'", ch.Address, u.Name), nil)
 
 	// Add the new stream to as the "current running stream" for this user.
-	streams[u.Name] = Command{
+	setStream(u.Name, Command{
 		Name:      ch.Name,
 		Cmd:       cmd,
 		Transcode: transcoding,
 		Address:   ch.Address,
-	}
+		Pid:       cmd.Process.Pid,
+	})
+	notifyLive()
 
 	// Write cubemap-config, this is ignored if config.CubemapConfig is empty.
 	// That is, it's ignored if we don't have Cubemap enabled.
@@ -866,57 +1012,6 @@ func startChannel(ch Channel, u User, transcoding int) error {
 	return nil
 }
 
-func addChannelHandler(w http.ResponseWriter, r *http.Request) {
-	// Add a channel, and if it already exist we edit the URL.
-	cname := r.FormValue("cname")
-	url := r.FormValue("url")
-	if cname == "" || url == "" {
-		logMessage("error", "Recieved malformed parameters to addChannel", nil)
-		fmt.Fprintf(w, "Error: malformed parameters.")
-		return
-	}
-
-	// Pass empty username, as we are only interested in config-channels.
-	channel, notfound := getChannel(cname, "")
-	if notfound != nil {
-		// The channel was not found, add it.
-		*(config.Channels) = append(*(config.Channels), Channel{Name: cname, Address: url})
-	} else {
-		// Channel was found, edit the url.
-		channel.Address = url
-	}
-	fmt.Fprintf(w, "Ok.")
-}
-
-func startExternalStream(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
-	user, err := getUserFromRequest(r)
-	if err != nil {
-		logMessage("error", "Authentication problem", err)
-		http.Redirect(w, &r.Request, config.BaseUrl, 302)
-	}
-
-	// Construct a custom channel, for this purpose
-	n := r.FormValue("name")
-	if n == "" {
-		n = "Egendefinert kanal"
-	}
-
-	// Get the transcoding, defaulting to 0.
-	transcoding := getTranscoding(r.FormValue("transcoding"))
-
-	s := Channel{
-		Name:    n,
-		Address: r.FormValue("url"),
-	}
-
-	err = startChannel(s, user, transcoding)
-	if err != nil {
-		logMessage("error", "Could not start external stream", err)
-	}
-
-	http.Redirect(w, &r.Request, config.BaseUrl, 302)
-}
-
 func parseTemplate(file string, data interface{}) ([]byte, error) {
 	var buf bytes.Buffer
 	t, err := template.ParseFiles(file)
@@ -950,20 +1045,13 @@ func uniPageHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
 		return
 	}
 
-	// Check if we already are playing a channel.
+	// Check if we already are playing a channel. Channels are changed through the API.
 	currentChannel := ""
-
-	// Check if we pass a channel name in parameters
-	channelName := r.FormValue("channel")
-
-	// Check if we want to transcode the stream.
-	ftranscoding := r.FormValue("transcoding")
-	transcoding := getTranscoding(ftranscoding)
 	currentTranscoding := 0
-
-	if _, ok := streams[user.Name]; ok {
-		currentChannel = streams[user.Name].Name
-		currentTranscoding = streams[user.Name].Transcode
+	stream, playing := getStream(user.Name)
+	if playing {
+		currentChannel = stream.Name
+		currentTranscoding = stream.Transcode
 	}
 
 	// Get number of elements to show in the EPG feed
@@ -973,42 +1061,17 @@ func uniPageHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
 		numEpg = 3
 	}
 
-	getEpgData(numEpg)
-
-	// Check that the form-values are non empty and that they are different from
-	// current configuration. If true, we kill stream and start a new one.
-	if (channelName != "" && channelName != currentChannel) || (ftranscoding != "" && transcoding != currentTranscoding) {
-		// First, get channel struct we want to change to.
-		channel, err := getChannel(channelName, user.Name)
-		if err != nil {
-			logMessage("error", "Could not get channel", err)
-			return
-		}
-
-		// Then kill existing stream and start the one chosen.
-		err = startChannel(*channel, user, transcoding)
-		if err != nil {
-			logMessage("error", "Could not change channel", err)
-		}
-
-		// Easiest now is just to redirect the user back to the index.
-		http.Redirect(w, &(r.Request), config.BaseUrl, 302)
-	}
-
-	// Check if requested to kill the channel, currently running..
-	kill_index := r.FormValue("kchannel")
-	if kill_index != "" {
-		err := killUniStream(user)
-		if err != nil {
-			logMessage("error", "Could not kill stream", err)
-		}
-		http.Redirect(w, &(r.Request), config.BaseUrl, 302)
-	}
+	// And possibly only show programmes in a category, in the time zone of the user.
+	category := r.FormValue("category")
+	// And the group or favourites chosen, with the favourites of the user first.
+	loc := getUserLocation(user.Name)
+	group, onlyFavourites, _ := getChannelFilter(r)
+	channels := getChannelsWithEpg(getUserChannels(user.Name, group, onlyFavourites), numEpg, category, loc)
 
 	// Get number of viewers on current channel
 	currentViewers := ""
-	if _, ok := streams[user.Name]; ok {
-		currentViewers = countStream(streams[user.Name].Cmd.Process.Pid, user)
+	if playing {
+		currentViewers = countStream(stream.Pid, user)
 	}
 
 	subscriptions, err := getSeriesSubscriptions(user.Name)
@@ -1022,29 +1085,39 @@ func uniPageHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
 		logMessage("error", "Could not get alle programs from DB", err)
 	}
 
-	// Get the URL for this user.
-	userPort := getUserPort(user)
-	userURL := fmt.Sprintf("http://%v:%d/%v", config.Hostname, userPort, user.Name)
-	if config.CubemapConfig != "" {
-		userURL = fmt.Sprintf("http://%s:%d/%s", config.Hostname, config.CubemapPort, user.Name)
+	// And the categories, for filtering.
+	categories, err := getAllCategories()
+	if err != nil {
+		logMessage("warn", "Could not get categories from DB", err)
+	}
+
+	// Get the planned recordings, with times for this user.
+	planned := make(map[int64]Recording)
+	for id, recording := range getRecordings() {
+		planned[id] = recording.In(loc)
 	}
 
-	// Get the recordings for this user.
 	d := make(map[string]interface{})
-	d["Recordings"] = recordings
+	d["Recordings"] = planned
 	d["RecordingsFolder"] = config.RecordingsFolder
 	d["Viewers"] = currentViewers
-	d["Channels"] = config.Channels
+	d["Channels"] = channels
 	d["BaseUrl"] = config.BaseUrl
 	d["User"] = user.Name
+	d["Admin"] = isAdmin(user.Name)
 	d["CurrentChannel"] = currentChannel
-	d["CurrentAddress"] = streams[user.Name].Address
+	d["CurrentAddress"] = stream.Address
 	d["Transcoding"] = currentTranscoding
 	d["Subscriptions"] = subscriptions
 	d["Programs"] = programs
-	d["URL"] = userURL
+	d["Categories"] = categories
+	d["Category"] = category
+	d["Groups"] = getChannelGroups()
+	d["Group"] = group
+	d["OnlyFavourites"] = onlyFavourites
+	d["URL"] = getUserURL(user)
 	d["Running"] = (currentChannel != "")
-	d["Refresh"] = true // Enable auto-refreshing
+	d["Live"] = true // Kept up to date by liveHandler
 
 	w.Write(getPage("index.html", d))
 }
@@ -1060,7 +1133,7 @@ func countStream(pid int, user User) string {
 		cmd = fmt.Sprintf("cat %v | grep %v | wc -l", config.CubemapStatsFile, user.Name)
 	} else {
 		userPort := getUserPort(user)
-		cmd = fmt.Sprintf("lsof -a -p %d -i tcp:%v%v | grep ESTABLISHED | wc -l", pid, userPort)
+		cmd = fmt.Sprintf("lsof -a -p %d -i tcp:%v | grep ESTABLISHED | wc -l", pid, userPort)
 	}
 	oneliner := exec.Command("bash", "-c", cmd)
 	out, _ := oneliner.Output()
@@ -1150,7 +1223,7 @@ func writeCubemapConfig() error {
 	}
 
 	// Add all running streams to the config-file.
-	for username, _ := range streams {
+	for username, _ := range getStreams() {
 		u, err := getUserFromName(username)
 		if err != nil {
 			return err
@@ -1192,14 +1265,14 @@ func autoStopStreams() {
 		count := 0
 
 		// Check all streams and if one has 0 viewers, kill it.
-		for username, stream := range streams {
+		for username, stream := range getStreams() {
 
 			// Get the number of viewers.
 			u, err := getUserFromName(username)
 			if err != nil {
 				logMessage("error", "Could not get username when checking for dead streams", err)
 			}
-			currView := countStream(stream.Cmd.Process.Pid, u)
+			currView := countStream(stream.Pid, u)
 			currentViewers, err := strconv.Atoi(currView)
 			if err != nil {
 				logMessage("error", "Could not convert currentViewers to int", err)
@@ -1236,6 +1309,7 @@ func handleSignals() {
 			if sig == syscall.SIGHUP {
 				// Reload the config.
 				config = loadConfig("config.json")
+				loadLocation()
 				logMessage("info", "Got SIGHUP. Reloaded config", nil)
 			}
 		}
@@ -1244,14 +1318,37 @@ func handleSignals() {
 
 func main() {
 	var cubemap = flag.String("cubemap", "", "Use cubemap as a VLC-reflector")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, commandUsage)
+	}
 	flag.Parse()
 
 	// First thing to do, read the configuration file.
 	config = loadConfig("config.json")
+	loadLocation()
+
+	// Run a command and exit, e.g. when run from cron, unless it is to serve.
+	if runCommand(flag.Args()) {
+		return
+	}
 
 	// Create the DBH
 	ensureDbhConnection()
 
+	if len(config.Admins) == 0 {
+		logMessage("warn", "No Admins in the config, so only the first user in "+config.PasswordFile+" is an admin", nil)
+	}
+
+	// Load the channels, which the first time come from the config-file.
+	err := seedChannels()
+	if err != nil {
+		logMessage("error", "Could not add the channels from the config-file", err)
+	}
+	err = loadChannels()
+	if err != nil {
+		logMessage("error", "Could not load channels", err)
+	}
+
 	// Listen for signals
 	handleSignals()
 
@@ -1271,16 +1368,28 @@ func main() {
 	}
 
 	// The server has (re)started, so we load in the planned recordings.
-	err := loadPlannedRecordings()
+	err = loadPlannedRecordings()
 	if err != nil {
 		logMessage("error", "Failed to initialize recordings", err)
 	}
 
-	// We also check if there are any subscriptions we should add
-	err = checkSubscriptions()
-	if err != nil {
-		logMessage("error", "Could not check and refresh the subscriptions", err)
-	}
+	// Check the subscriptions now, and then regularly and after each EPG-import.
+	go subscriptionScheduler()
+
+	// Delete recordings that no follower of the subscription wants to keep anymore.
+	go expireRecordingsLoop()
+
+	// Import EPG-data regularly, if configured.
+	go epgImportLoop()
+	go eitImportLoop()
+	go epgCacheLoop()
+
+	// Send events to webhooks and users, and warn when the disk gets full.
+	go eventLoop()
+	go diskSpaceLoop()
+
+	// Apply what the commands change, e.g. recordings planned from cron.
+	go listenForChanges()
 
 	// Start a thread checking for stopped streams, killing them if no one are watching.
 	go autoStopStreams()
@@ -1289,17 +1398,29 @@ func main() {
 	secrets := auth.HtpasswdFileProvider(config.PasswordFile)
 	authenticator := auth.NewBasicAuthenticator(config.Hostname, secrets)
 	http.HandleFunc("/", authenticator.Wrap(uniPageHandler))
-	http.HandleFunc("/external", authenticator.Wrap(startExternalStream))
-	http.HandleFunc("/record", authenticator.Wrap(startRecordingHandler))
-	http.HandleFunc("/stopRecording", authenticator.Wrap(stopRecordingHandler))
 	http.HandleFunc("/archive", authenticator.Wrap(archivePageHandler))
-	http.HandleFunc("/startSubscription", authenticator.Wrap(startSeriesSubscription))
-	http.HandleFunc("/deleteSubscription", authenticator.Wrap(removeSubscriptionHandler))
+	http.HandleFunc("/previewSubscription", authenticator.Wrap(previewSubscriptionHandler))
+	http.HandleFunc("/admin", authenticator.Wrap(adminPageHandler))
+	http.HandleFunc("/search", authenticator.Wrap(searchPageHandler))
+	http.HandleFunc("/guide", authenticator.Wrap(guidePageHandler))
+	http.HandleFunc("/xmltv", tokenAuth(authenticator, xmltvExportHandler))
+	http.HandleFunc("/calendar.ics", tokenAuth(authenticator, calendarHandler))
+	http.HandleFunc("/settings", authenticator.Wrap(settingsPageHandler))
+	http.HandleFunc("/favourites", authenticator.Wrap(favouritesHandler))
+	http.HandleFunc("/nownext", authenticator.Wrap(nowNextHandler))
+	http.HandleFunc("/live", authenticator.Wrap(liveHandler))
+	http.HandleFunc("/admin/channels", authenticator.Wrap(channelsPageHandler))
+	http.HandleFunc("/api/v1/", authenticator.Wrap(apiHandler))
+	http.HandleFunc("/admin/channels/import", authenticator.Wrap(channelsImportHandler))
+	http.HandleFunc("/playlist.m3u", tokenAuth(authenticator, playlistHandler))
+	http.HandleFunc("/tune", tokenAuth(authenticator, tuneHandler))
+	http.HandleFunc("/hdhomerun/", hdhomerunHandler)
+	http.HandleFunc("/metrics", metricsHandler)
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/readyz", readyzHandler)
 	http.HandleFunc("/"+config.RecordingsFolder+"/", authenticator.Wrap(fileServerHandler))
 
 	// No auth
-	http.HandleFunc("/checkSubscriptions", checkSubscriptionsHandler)
-	http.HandleFunc("/addChannel", addChannelHandler)
 	http.HandleFunc("/vlc", startVlcHandler)
 
 	// Static content, including video-files of old recordings.
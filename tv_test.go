@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetRecordingOwner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "teve-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config.PasswordFile = filepath.Join(dir, ".htpasswd")
+	defer func() { config.PasswordFile = "" }()
+	err = ioutil.WriteFile(config.PasswordFile, []byte("espen:x\nkari:x\nole-kari:x\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"2026-10-19-19-00-Dagsrevyen-espen.mkv", "espen"},
+		{"2026-10-19-19-00-Side-om-side-kari.mkv", "kari"},
+		{"2026-10-19-19-00-Lindmo-ole-kari.mkv", "ole-kari"},
+		{"2026-10-19-19-00-Lindmo-per.mkv", ""},
+		{"espen.mkv", ""},
+	}
+	for _, test := range tests {
+		if got := getRecordingOwner(test.name); got != test.want {
+			t.Errorf("getRecordingOwner(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
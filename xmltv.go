@@ -0,0 +1,597 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/lib/pq"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+type xmltvText struct {
+	Lang  string `xml:"lang,attr,omitempty"`
+	Value string `xml:",chardata"`
+}
+
+type xmltvEpisodeNum struct {
+	System string `xml:"system,attr,omitempty"`
+	Value  string `xml:",chardata"`
+}
+
+type xmltvCredits struct {
+	Directors    []string `xml:"director"`
+	Actors       []string `xml:"actor"`
+	Writers      []string `xml:"writer"`
+	Producers    []string `xml:"producer"`
+	Presenters   []string `xml:"presenter"`
+	Commentators []string `xml:"commentator"`
+	Guests       []string `xml:"guest"`
+}
+
+type xmltvRating struct {
+	System string `xml:"system,attr,omitempty"`
+	Value  string `xml:"value"`
+}
+
+type xmltvIcon struct {
+	Src string `xml:"src,attr"`
+}
+
+type xmltvProgramme struct {
+	Start       string            `xml:"start,attr"`
+	Stop        string            `xml:"stop,attr"`
+	Channel     string            `xml:"channel,attr"`
+	Titles      []xmltvText       `xml:"title"`
+	SubTitles   []xmltvText       `xml:"sub-title"`
+	Descs       []xmltvText       `xml:"desc"`
+	Credits     *xmltvCredits     `xml:"credits"`
+	Categories  []xmltvText       `xml:"category"`
+	EpisodeNums []xmltvEpisodeNum `xml:"episode-num"`
+	Ratings     []xmltvRating     `xml:"rating"`
+	Icons       []xmltvIcon       `xml:"icon"`
+}
+
+// A programme from an EPG-source, ready to be put in the epg-table.
+type Programme struct {
+	Channel     string
+	Title       string
+	SubTitle    string
+	Description string
+	EpisodeNum  string
+	Categories  []string
+	Rating      string
+	Credits     map[string][]string
+	Icon        string
+	Start       time.Time
+	Stop        time.Time
+}
+
+type EPGImport struct {
+	Source     string
+	Started    string
+	Duration   string
+	Programmes int
+	Error      string
+}
+
+// Where programmes from several sources overlap, those with the highest
+// priority are kept. XMLTV has the most details, so it wins unless configured.
+var defaultEpgPriority = map[string]int{
+	"xmltv": 10,
+	"eit":   5,
+}
+
+// Layouts used for times in XMLTV, with and without seconds and time zone.
+var xmltvTimeLayouts = []string{
+	"20060102150405 -0700",
+	"200601021504 -0700",
+	"20060102150405",
+	"200601021504",
+}
+
+func parseXmltvTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range xmltvTimeLayouts {
+		// Times without a zone are in the one of the server.
+		t, err := time.ParseInLocation(layout, s, getLocation())
+		if err == nil {
+			return t.In(getLocation()), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Could not parse XMLTV time '%s'", s)
+}
+
+func preferNorwegian(texts []xmltvText) string {
+	// They differientiate betwen languages, and we preffer norwegian.
+	for _, lang := range []string{"no", "nb", "nn"} {
+		for _, t := range texts {
+			if t.Lang == lang {
+				return strings.TrimSpace(t.Value)
+			}
+		}
+	}
+	if len(texts) > 0 {
+		return strings.TrimSpace(texts[0].Value)
+	}
+	return ""
+}
+
+func getEpisodeNum(nums []xmltvEpisodeNum) string {
+	// Prefer the machine readable episode numbering, if there are several.
+	num := ""
+	for _, n := range nums {
+		if num == "" || n.System == "xmltv_ns" {
+			num = strings.TrimSpace(n.Value)
+		}
+	}
+	return num
+}
+
+func getCategories(texts []xmltvText) []string {
+	// Keep the categories in all languages, so filters work in any of them.
+	var categories []string
+	seen := make(map[string]bool)
+	for _, t := range texts {
+		category := strings.TrimSpace(t.Value)
+		if category != "" && !seen[category] {
+			seen[category] = true
+			categories = append(categories, category)
+		}
+	}
+	return categories
+}
+
+func getRating(ratings []xmltvRating) string {
+	// There may be several rating systems, we just show the first.
+	for _, r := range ratings {
+		if value := strings.TrimSpace(r.Value); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func getIcon(icons []xmltvIcon) string {
+	if len(icons) > 0 {
+		return strings.TrimSpace(icons[0].Src)
+	}
+	return ""
+}
+
+func getCreditRoles(c *xmltvCredits) map[string][]string {
+	roles := make(map[string][]string)
+	if c == nil {
+		return roles
+	}
+	add := func(role string, names []string) {
+		for _, name := range names {
+			if name = strings.TrimSpace(name); name != "" {
+				roles[role] = append(roles[role], name)
+			}
+		}
+	}
+	add("director", c.Directors)
+	add("actor", c.Actors)
+	add("writer", c.Writers)
+	add("producer", c.Producers)
+	add("presenter", c.Presenters)
+	add("commentator", c.Commentators)
+	add("guest", c.Guests)
+	return roles
+}
+
+func getEpgChannelMap() map[string][]string {
+	// Several channels may share the same EPG, e.g. the HD and SD version.
+	m := make(map[string][]string)
+	for _, channel := range getChannels() {
+		if channel.EPGId != "" {
+			m[channel.EPGId] = append(m[channel.EPGId], channel.Name)
+		}
+	}
+	return m
+}
+
+// The whole download, so a stalled source does not hold up the imports.
+var epgClient = &http.Client{Timeout: 5 * time.Minute}
+
+func openEpgSource(source string) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		resp, err := epgClient.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("Got status '%s' fetching %s", resp.Status, source)
+		}
+		rc = resp.Body
+	} else {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		rc = f
+	}
+
+	// Check for the gzip magic number, instead of trusting file names and headers.
+	br := bufio.NewReader(rc)
+	magic, _ := br.Peek(2)
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{gz, rc}, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{br, rc}, nil
+}
+
+func parseXmltv(r io.Reader, channels map[string][]string) ([]Programme, error) {
+	var programmes []Programme
+
+	// Stream through the document, as a week of EPG is quite big.
+	decoder := xml.NewDecoder(r)
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		// Latin-1 maps directly to the first 256 code points.
+		if strings.EqualFold(charset, "iso-8859-1") || strings.EqualFold(charset, "latin1") {
+			return newLatin1Reader(input), nil
+		}
+		return nil, fmt.Errorf("Unsupported XMLTV charset '%s'", charset)
+	}
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return programmes, err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "programme" {
+			continue
+		}
+
+		var p xmltvProgramme
+		err = decoder.DecodeElement(&p, &start)
+		if err != nil {
+			return programmes, err
+		}
+
+		// Skip channels we don't have.
+		names, ok := channels[p.Channel]
+		if !ok {
+			continue
+		}
+		startTime, err := parseXmltvTime(p.Start)
+		if err != nil {
+			logMessage("warn", "Skipping XMLTV programme", err)
+			continue
+		}
+		stopTime, err := parseXmltvTime(p.Stop)
+		if err != nil {
+			logMessage("warn", "Skipping XMLTV programme", err)
+			continue
+		}
+		for _, name := range names {
+			programmes = append(programmes, Programme{
+				Channel:     name,
+				Title:       preferNorwegian(p.Titles),
+				SubTitle:    preferNorwegian(p.SubTitles),
+				Description: preferNorwegian(p.Descs),
+				EpisodeNum:  getEpisodeNum(p.EpisodeNums),
+				Categories:  getCategories(p.Categories),
+				Rating:      getRating(p.Ratings),
+				Credits:     getCreditRoles(p.Credits),
+				Icon:        getIcon(p.Icons),
+				Start:       startTime,
+				Stop:        stopTime,
+			})
+		}
+	}
+	return programmes, nil
+}
+
+func getEpgPriority(source string) int {
+	if priority, ok := config.EPGPriority[source]; ok {
+		return priority
+	}
+	return defaultEpgPriority[source]
+}
+
+func upsertProgrammes(programmes []Programme, source string) error {
+	// We'll use the DB, so ensure it is up.
+	ensureDbhConnection()
+
+	tx, err := dbh.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Load everything into a temporary table first, and merge it from there.
+	_, err = tx.Exec("CREATE TEMP TABLE epg_import (LIKE epg INCLUDING DEFAULTS) ON COMMIT DROP")
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`INSERT INTO epg_import(title, start, stop, channel, description, sub_title, episode_num,
+                           categories, rating, credits, icon)
+                           VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`)
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for _, p := range programmes {
+		// A source may list the same programme twice, use the first one.
+		key := p.Channel + "\x00" + p.Start.String()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		credits, err := json.Marshal(p.Credits)
+		if err != nil {
+			stmt.Close()
+			return err
+		}
+		_, err = stmt.Exec(p.Title, p.Start, p.Stop, p.Channel, p.Description, p.SubTitle, p.EpisodeNum,
+			pq.Array(p.Categories), p.Rating, string(credits), p.Icon)
+		if err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+	stmt.Close()
+
+	// Programmes that have been removed or moved in the source are deleted, but
+	// only within the period the source covers for that channel. The EIT only
+	// has what was sent while we listened, so there a missing programme may
+	// just not have been repeated in time.
+	priority := getEpgPriority(source)
+	if source != "eit" {
+		_, err = tx.Exec(`DELETE FROM epg USING (
+                        SELECT channel, min(start) AS first, max(stop) AS last FROM epg_import GROUP BY channel
+                      ) AS imported
+                      WHERE epg.channel = imported.channel
+                      AND epg.source = $1
+                      AND epg.start >= imported.first
+                      AND epg.start < imported.last
+                      AND NOT EXISTS (SELECT 1 FROM epg_import i WHERE i.channel = epg.channel AND i.start = epg.start)`, source)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Sources with a higher priority win where programmes overlap, and replace
+	// those of sources with the same or a lower priority.
+	_, err = tx.Exec(`DELETE FROM epg_import i USING epg
+                    WHERE epg.channel = i.channel
+                    AND epg.source <> $1
+                    AND epg.priority > $2
+                    AND epg.start < i.stop
+                    AND epg.stop > i.start`, source, priority)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM epg USING epg_import i
+                    WHERE epg.channel = i.channel
+                    AND epg.source <> $1
+                    AND epg.priority <= $2
+                    AND epg.start <> i.start
+                    AND epg.start < i.stop
+                    AND epg.stop > i.start`, source, priority)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO epg(title, start, stop, channel, description, sub_title, episode_num,
+                    categories, rating, credits, icon, source, priority)
+                    SELECT title, start, stop, channel, description, sub_title, episode_num,
+                    categories, rating, credits, icon, $1, $2 FROM epg_import
+                    ON CONFLICT (channel, start) DO UPDATE
+                    SET title = EXCLUDED.title, stop = EXCLUDED.stop, description = EXCLUDED.description,
+                    sub_title = EXCLUDED.sub_title, episode_num = EXCLUDED.episode_num,
+                    categories = EXCLUDED.categories, rating = EXCLUDED.rating,
+                    credits = EXCLUDED.credits, icon = EXCLUDED.icon,
+                    source = EXCLUDED.source, priority = EXCLUDED.priority
+                    WHERE epg.priority <= EXCLUDED.priority`, source, priority)
+	if err != nil {
+		return err
+	}
+
+	// And get rid of old programmes, if configured.
+	if config.EPGKeepDays > 0 {
+		_, err = tx.Exec("DELETE FROM epg WHERE stop < now() - $1 * interval '1 day'", config.EPGKeepDays)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func getEpgSources() []string {
+	// Sources may have an {id} in them, for sources with a file per channel, and
+	// a {date} for sources with a file per day.
+	days := config.EPGFetchDays
+	if days <= 0 {
+		days = 4
+	}
+	var sources []string
+	for _, source := range config.EPGSources {
+		expanded := []string{source}
+		if strings.Contains(source, "{id}") {
+			expanded = nil
+			for id, _ := range getEpgChannelMap() {
+				expanded = append(expanded, strings.Replace(source, "{id}", id, -1))
+			}
+		}
+		for _, s := range expanded {
+			if !strings.Contains(s, "{date}") {
+				sources = append(sources, s)
+				continue
+			}
+			for i := 0; i < days; i++ {
+				date := time.Now().In(getLocation()).AddDate(0, 0, i).Format("2006-01-02")
+				sources = append(sources, strings.Replace(s, "{date}", date, -1))
+			}
+		}
+	}
+	return sources
+}
+
+func importEpgSource(source string, channels map[string][]string) (int, error) {
+	rc, err := openEpgSource(source)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	programmes, err := parseXmltv(rc, channels)
+	if err != nil {
+		return 0, err
+	}
+	return len(programmes), upsertProgrammes(programmes, "xmltv")
+}
+
+func importEpg() error {
+	channels := getEpgChannelMap()
+	if len(channels) == 0 {
+		return fmt.Errorf("No channels have an EPGId, so there is nothing to import")
+	}
+
+	// Import each source on its own, so one failing source does not stop the others.
+	failed := 0
+	for _, source := range getEpgSources() {
+		started := time.Now()
+		count, err := importEpgSource(source, channels)
+		errstr := ""
+		if err != nil {
+			logMessage("warn", fmt.Sprintf("Could not import EPG from %s", source), err)
+			errstr = err.Error()
+			failed += 1
+		} else {
+			logMessage("info", fmt.Sprintf("Imported %d programmes from %s", count, source), nil)
+		}
+
+		_, err = dbh.Exec(`INSERT INTO epg_imports(source, started, finished, programmes, error)
+                       VALUES ($1, $2, $3, $4, $5)`, source, started, time.Now(), count, errstr)
+		if err != nil {
+			logMessage("warn", "Could not save the EPG import", err)
+		}
+	}
+
+	// Show the new programmes, which may also match subscriptions.
+	refreshEpgCache()
+	triggerSubscriptionCheck("EPG-import")
+
+	if failed > 0 {
+		return fmt.Errorf("%d EPG sources failed", failed)
+	}
+	return nil
+}
+
+func epgImportLoop() {
+	if config.EPGImportInterval == 0 {
+		// Don't import by ourself if config variable is 0.
+		return
+	}
+
+	for {
+		err := importEpg()
+		if err != nil {
+			logMessage("warn", "EPG import failed", err)
+		}
+
+		// Sleep X hours, and import again.
+		time.Sleep(time.Duration(config.EPGImportInterval) * time.Hour)
+	}
+}
+
+func getEpgImports(limit int) ([]EPGImport, error) {
+	// We'll use the DB, so ensure it is up.
+	ensureDbhConnection()
+
+	rows, err := dbh.Query(`SELECT source, started, finished, programmes, error
+                          FROM epg_imports
+                          ORDER BY started DESC
+                          LIMIT $1`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var imports []EPGImport
+	for rows.Next() {
+		var source, errstr string
+		var started, finished time.Time
+		var count int
+		err := rows.Scan(&source, &started, &finished, &count, &errstr)
+		if err != nil {
+			return imports, err
+		}
+		imports = append(imports, EPGImport{
+			Source:     source,
+			Started:    started.In(getLocation()).Format("2006-01-02 15:04:05"),
+			Duration:   finished.Sub(started).String(),
+			Programmes: count,
+			Error:      errstr,
+		})
+	}
+	return imports, rows.Err()
+}
+
+func getEpgStats() (int64, time.Time, error) {
+	// We'll use the DB, so ensure it is up.
+	ensureDbhConnection()
+
+	// The programmes we have, and when an import last went well.
+	var count int64
+	var last pq.NullTime
+	err := dbh.QueryRow(`SELECT (SELECT count(*) FROM epg),
+                       (SELECT max(finished) FROM epg_imports WHERE error = '')`).Scan(&count, &last)
+	return count, last.Time, err
+}
+
+type latin1Reader struct {
+	r   io.Reader
+	buf []byte
+}
+
+func newLatin1Reader(r io.Reader) io.Reader {
+	return &latin1Reader{r: r}
+}
+
+func (l *latin1Reader) Read(p []byte) (int, error) {
+	// Each byte may become two in UTF-8, so read at most half of what fits.
+	if len(p) < 2 {
+		return 0, io.ErrShortBuffer
+	}
+	if cap(l.buf) < len(p)/2 {
+		l.buf = make([]byte, len(p)/2)
+	}
+	n, err := l.r.Read(l.buf[:len(p)/2])
+	out := 0
+	for _, b := range l.buf[:n] {
+		if b < 0x80 {
+			p[out] = b
+			out += 1
+		} else {
+			p[out] = 0xc0 | b>>6
+			p[out+1] = 0x80 | b&0x3f
+			out += 2
+		}
+	}
+	return out, err
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const xmltvSample = `<?xml version="1.0" encoding="ISO-8859-1"?>
+<tv>
+  <channel id="nrk1.nrk.no"><display-name>NRK1</display-name></channel>
+  <programme start="20261019190000 +0200" stop="20261019194500 +0200" channel="nrk1.nrk.no">
+    <title lang="en">Evening news</title>
+    <title lang="nb">Dagsrevyen</title>
+    <sub-title lang="nb">Nyheter fr` + "\xe5" + ` Norge</sub-title>
+    <desc lang="nb"> Nyhetene. </desc>
+    <credits><presenter>Kari Nordmann</presenter><presenter> </presenter></credits>
+    <category lang="nb">Nyheter</category>
+    <category lang="en">News</category>
+    <category lang="nb">Nyheter</category>
+    <episode-num system="onscreen">Episode 5</episode-num>
+    <episode-num system="xmltv_ns">0.4.</episode-num>
+    <rating system="MPAA"><value>A</value></rating>
+    <icon src="http://example.com/dagsrevyen.png"/>
+  </programme>
+  <programme start="20261019194500 +0200" stop="20261019200000 +0200" channel="other.example.com">
+    <title>Skipped</title>
+  </programme>
+  <programme start="bad" stop="20261019200000 +0200" channel="nrk1.nrk.no">
+    <title>Bad time</title>
+  </programme>
+</tv>
+`
+
+func TestParseXmltvTime(t *testing.T) {
+	config.TimeZone = "Europe/Oslo"
+	loadLocation()
+	defer func() {
+		config.TimeZone = ""
+		loadLocation()
+	}()
+
+	tests := []struct {
+		s    string
+		want time.Time
+	}{
+		{"20261019190000 +0200", time.Date(2026, 10, 19, 17, 0, 0, 0, time.UTC)},
+		{"202610191900 +0000", time.Date(2026, 10, 19, 19, 0, 0, 0, time.UTC)},
+		{" 20261019190000 ", time.Date(2026, 10, 19, 17, 0, 0, 0, time.UTC)},
+		// Without a zone, in the one of the server, also in winter.
+		{"202612241800", time.Date(2026, 12, 24, 17, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		got, err := parseXmltvTime(test.s)
+		if err != nil || !got.Equal(test.want) {
+			t.Errorf("parseXmltvTime(%q) = %v, %v, want %v", test.s, got, err, test.want)
+		}
+		if got.Location() != getLocation() {
+			t.Errorf("parseXmltvTime(%q) is in %v, want the time zone of the server", test.s, got.Location())
+		}
+	}
+	for _, s := range []string{"", "2026-10-19 19:00", "20261019"} {
+		if _, err := parseXmltvTime(s); err == nil {
+			t.Errorf("parseXmltvTime(%q) should fail", s)
+		}
+	}
+}
+
+func TestParseXmltv(t *testing.T) {
+	channels := map[string][]string{"nrk1.nrk.no": {"NRK1", "NRK1 HD"}}
+	programmes, err := parseXmltv(strings.NewReader(xmltvSample), channels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(programmes) != 2 {
+		t.Fatalf("Got %d programmes, want one for each of the two channels", len(programmes))
+	}
+	p := programmes[0]
+	if p.Channel != "NRK1" || programmes[1].Channel != "NRK1 HD" {
+		t.Errorf("Channels = %q and %q", p.Channel, programmes[1].Channel)
+	}
+	if p.Title != "Dagsrevyen" || p.SubTitle != "Nyheter frå Norge" || p.Description != "Nyhetene." {
+		t.Errorf("Texts = %q, %q, %q", p.Title, p.SubTitle, p.Description)
+	}
+	if p.EpisodeNum != "0.4." || p.Rating != "A" || p.Icon != "http://example.com/dagsrevyen.png" {
+		t.Errorf("EpisodeNum, Rating, Icon = %q, %q, %q", p.EpisodeNum, p.Rating, p.Icon)
+	}
+	if strings.Join(p.Categories, ",") != "Nyheter,News" {
+		t.Errorf("Categories = %v", p.Categories)
+	}
+	if presenters := p.Credits["presenter"]; len(presenters) != 1 || presenters[0] != "Kari Nordmann" {
+		t.Errorf("Presenters = %v", presenters)
+	}
+	if !p.Start.Equal(time.Date(2026, 10, 19, 17, 0, 0, 0, time.UTC)) || p.Stop.Sub(p.Start) != 45*time.Minute {
+		t.Errorf("Start, Stop = %v, %v", p.Start, p.Stop)
+	}
+}
+
+func TestParseXmltvCharset(t *testing.T) {
+	doc := strings.Replace(xmltvSample, "ISO-8859-1", "KOI8-R", 1)
+	if _, err := parseXmltv(strings.NewReader(doc), nil); err == nil {
+		t.Errorf("parseXmltv should fail on an unknown charset")
+	}
+}
+
+func TestOpenEpgSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "teve-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The same document, plain and gzipped whatever the name says.
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(xmltvSample))
+	w.Close()
+	files := map[string][]byte{"plain.xml.gz": []byte(xmltvSample), "gzipped.xml": gz.Bytes()}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		r, err := openEpgSource(path)
+		if err != nil {
+			t.Fatalf("openEpgSource(%s): %v", name, err)
+		}
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || string(got) != xmltvSample {
+			t.Errorf("openEpgSource(%s) read %d bytes, %v, want the document", name, len(got), err)
+		}
+	}
+}
+
+func TestLatin1Reader(t *testing.T) {
+	got, err := ioutil.ReadAll(newLatin1Reader(strings.NewReader("Bl\xe5b\xe6r og \xf8l")))
+	if err != nil || string(got) != "Blåbær og øl" {
+		t.Errorf("latin1Reader read %q, %v", got, err)
+	}
+}